@@ -0,0 +1,90 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultHostAffinityTTL thời gian giữ session của 1 host nếu Config.HostAffinityTTL = 0
+const defaultHostAffinityTTL = 30 * time.Minute
+
+// hostSession session sticky gắn với 1 target host
+type hostSession struct {
+	seed     string    // seed sinh token, cố định trong suốt session
+	lastUsed time.Time // hết hạn khi lastUsed + HostAffinityTTL < now
+}
+
+// GetAvailableProxyForHost giống GetAvailableProxy nhưng với sticky proxy, {random}/{session:N}
+// được thay bằng token cố định theo host: cùng host luôn nhận cùng session (cùng IP),
+// host khác nhau nhận session khác nhau trên cùng 1 dòng sticky proxy.
+// Session của host hết hạn sau HostAffinityTTL kể từ lần dùng cuối.
+// Các loại proxy khác (và khi bật IsBlockAssets) trả về như GetAvailableProxy
+func (pm *ProxyManager) GetAvailableProxyForHost(threadId int, host string) (id int64, proxyStr string, err error) {
+	id, proxyStr, err = pm.GetAvailableProxy(threadId)
+	if err != nil {
+		return 0, "", err
+	}
+	host = normalizeHost(host)
+	if host == "" {
+		return id, proxyStr, nil
+	}
+
+	pm.mu.RLock()
+	p, ok := pm.proxyCache[id]
+	if !ok || p.Type != ProxyTypeSticky || pm.isBlockAssets {
+		pm.mu.RUnlock()
+		return id, proxyStr, nil
+	}
+	rawProxyStr := p.ProxyStr
+	tokenLen, alphabet := pm.stickyTokenLen, pm.stickyTokenAlphabet
+	pm.mu.RUnlock()
+
+	seed := fmt.Sprintf("%s|%d", pm.hostSessionSeed(host), id)
+	return id, expandStickyPlaceholders(rawProxyStr, tokenLen, func(length int) string {
+		return deterministicToken(seed, length, alphabet)
+	}), nil
+}
+
+// hostSessionSeed trả về seed session của host, tạo mới nếu chưa có hoặc đã hết hạn
+func (pm *ProxyManager) hostSessionSeed(host string) string {
+	ttl := pm.hostAffinityTTL
+	if ttl <= 0 {
+		ttl = defaultHostAffinityTTL
+	}
+	now := time.Now()
+
+	pm.sessionMu.Lock()
+	defer pm.sessionMu.Unlock()
+
+	// Dọn các session đã hết hạn
+	for h, s := range pm.hostSessions {
+		if now.Sub(s.lastUsed) > ttl {
+			delete(pm.hostSessions, h)
+		}
+	}
+
+	s, ok := pm.hostSessions[host]
+	if !ok {
+		s = &hostSession{seed: generateRandomString(16)}
+		pm.hostSessions[host] = s
+	}
+	s.lastUsed = now
+	return s.seed
+}
+
+// normalizeHost chuẩn hoá host: bỏ scheme/port/path, chữ thường
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(strings.ToLower(host))
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]")
+}
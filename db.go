@@ -4,14 +4,23 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/tuwibu/goproxy/service"
+	"github.com/hashicorp/go-multierror"
 
 	_ "modernc.org/sqlite"
 )
@@ -27,61 +36,151 @@ func initDB(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
-func (pm *ProxyManager) initSchema() error {
-	_, err := pm.db.Exec(`
-	CREATE TABLE IF NOT EXISTS proxies (
-		id INTEGER PRIMARY KEY,
-		type TEXT NOT NULL,
-		proxy_str TEXT,
-		api_key TEXT,
-		unique_key TEXT UNIQUE,
-		min_time INTEGER,
-		change_url TEXT,
-		running INTEGER DEFAULT 0,
-		used INTEGER DEFAULT 0,
-		is_unique INTEGER DEFAULT 0,
-		last_changed INTEGER,
-		last_ip TEXT,
-		error TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	CREATE INDEX IF NOT EXISTS idx_type ON proxies(type);
-	CREATE INDEX IF NOT EXISTS idx_unique_key ON proxies(unique_key);
-	`)
-	if err != nil {
-		return err
+func (pm *ProxyManager) Close() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.watchCancel != nil {
+		pm.watchCancel()
+		pm.watchCancel = nil
+	}
+	if pm.scheduleCancel != nil {
+		pm.scheduleCancel()
+		pm.scheduleCancel = nil
+	}
+	if pm.cancel != nil {
+		pm.cancel()
 	}
+	pm.queryMu.Lock()
+	if pm.queryConn != nil {
+		pm.queryConn.Close()
+		pm.queryConn = nil
+	}
+	pm.queryMu.Unlock()
+	if pm.db != nil {
+		return pm.db.Close()
+	}
+	return nil
+}
 
-	// Migration: Thêm cột is_unique nếu chưa tồn tại
-	pm.db.Exec(`ALTER TABLE proxies ADD COLUMN is_unique INTEGER DEFAULT 0`)
+// baseContext ctx của ProxyManager, bị huỷ khi Close
+func (pm *ProxyManager) baseContext() context.Context {
+	if pm.ctx == nil {
+		return context.Background()
+	}
+	return pm.ctx
+}
 
-	// Migration: Cập nhật is_unique=1 cho các proxy type cũ
-	pm.db.Exec(`UPDATE proxies SET is_unique=1 WHERE type IN ('tmproxy', 'mobilehop', 'static', 'kiotproxy', 'auto', 'ipv4xoay')`)
+// withManagerContext trả về ctx bị huỷ khi ctx của caller bị huỷ hoặc ProxyManager bị Close
+func (pm *ProxyManager) withManagerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(pm.baseContext(), cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
 
-	// Migration: Thêm cột thread_id nếu chưa tồn tại
-	pm.db.Exec(`ALTER TABLE proxies ADD COLUMN thread_id INTEGER`)
+// Query chạy câu truy vấn tuỳ chỉnh (chỉ đọc) trên database, dùng cho các thống kê nâng cao
+// Chỉ chấp nhận 1 câu lệnh SELECT/WITH. Query chạy trên connection riêng đặt PRAGMA query_only nên SQLite
+// từ chối mọi câu lệnh ghi (kể cả lọt qua kiểm tra cú pháp), rows không giữ pm.mu trong lúc người gọi đọc
+// Người gọi phải Close() rows sau khi dùng xong
+func (pm *ProxyManager) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if err := validateReadOnlyQuery(query); err != nil {
+		return nil, err
+	}
 
-	return nil
+	conn, err := pm.readOnlyConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.QueryContext(context.Background(), query, args...)
 }
 
-func (pm *ProxyManager) Close() error {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	if pm.db != nil {
-		return pm.db.Close()
+// readOnlyConn trả về connection chỉ đọc của Query, mở từ pool của pm.db khi được gọi lần đầu
+func (pm *ProxyManager) readOnlyConn() (*sql.Conn, error) {
+	pm.queryMu.Lock()
+	defer pm.queryMu.Unlock()
+	if pm.queryConn != nil {
+		return pm.queryConn, nil
+	}
+
+	ctx := context.Background()
+	conn, err := pm.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// read_uncommitted: với shared cache (MemoryOpener) connection đọc không giữ khoá bảng, không chặn lệnh ghi của ProxyManager
+	for _, pragma := range []string{"PRAGMA query_only=1", "PRAGMA read_uncommitted=1"} {
+		if _, err := conn.ExecContext(ctx, pragma); err != nil {
+			// Không trả connection về pool khi chưa rõ pragma nào đã được áp dụng
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+			conn.Close()
+			return nil, err
+		}
+	}
+	pm.queryConn = conn
+	return conn, nil
+}
+
+// validateReadOnlyQuery kiểm tra query chỉ gồm 1 câu lệnh SELECT/WITH
+func validateReadOnlyQuery(query string) error {
+	trimmed := strings.TrimSpace(query)
+	trimmed = strings.TrimSpace(strings.TrimRight(trimmed, ";"))
+	if strings.Contains(trimmed, ";") {
+		return fmt.Errorf("multiple statements are not allowed")
+	}
+
+	fields := strings.Fields(strings.ToUpper(trimmed))
+	if len(fields) == 0 || (fields[0] != "SELECT" && fields[0] != "WITH") {
+		return fmt.Errorf("only SELECT queries are allowed")
+	}
+	for _, f := range fields {
+		switch f {
+		case "INSERT", "UPDATE", "DELETE", "DROP", "ALTER", "CREATE", "REPLACE", "ATTACH", "DETACH", "PRAGMA", "VACUUM":
+			return fmt.Errorf("only SELECT queries are allowed")
+		}
 	}
 	return nil
 }
 
 // getConnectionString trả về connection string để sử dụng
-// Nếu IsBlockAssets = true, trả về localhost:port (port = 20000 + proxyID)
+// Nếu IsBlockAssets = true, trả về localhost:port (port = 20000 + proxyID) của instance (socks5://localhost:port nếu LocalProtocol là socks5)
+// kể cả khi instance chưa chạy (được khởi động qua ensureInstance trước khi trả proxy), không bao giờ trả về upstream thật
 // Ngược lại trả về proxyStr
 func (pm *ProxyManager) getConnectionString(proxyID int64, proxyStr string) string {
-	if pm.isBlockAssets {
-		return fmt.Sprintf("127.0.0.1:%d", BasePort+int(proxyID))
+	if !pm.isBlockAssets {
+		return proxyStr
+	}
+	if addr, ok := GetDumbProxyManager().GetAddress(proxyID); ok {
+		return addr
+	}
+	return GetDumbProxyManager().localAddressFor(proxyID)
+}
+
+// ensureInstance đảm bảo proxy vừa cấp phát có dumbproxy instance đang chạy (chỉ khi IsBlockAssets)
+func (pm *ProxyManager) ensureInstance(id int64) error {
+	pm.mu.RLock()
+	if !pm.isBlockAssets {
+		pm.mu.RUnlock()
+		return nil
+	}
+	p, ok := pm.proxyCache[id]
+	if !ok || p.ProxyStr == "" {
+		pm.mu.RUnlock()
+		return nil
+	}
+	upstream := p.ProxyStr
+	busy := make(map[int64]bool)
+	for pid, cached := range pm.proxyCache {
+		if cached.Running {
+			busy[pid] = true
+		}
 	}
-	return proxyStr
+	busy[id] = true
+	pm.mu.RUnlock()
+
+	_, err := GetDumbProxyManager().EnsureInstance(id, upstream, busy)
+	return err
 }
 
 // restartDumbProxyInstance restart dumbproxy instance với upstream mới
@@ -91,77 +190,424 @@ func (pm *ProxyManager) restartDumbProxyInstance(proxyID int64, newProxyStr stri
 		return
 	}
 
-	// IsBlockAssets = true: restart dumbproxy instance với upstream mới
-	GetDumbProxyManager().StartInstance(proxyID, newProxyStr)
+	// IsBlockAssets = true: thay upstream của instance đang chạy (giữ nguyên port)
+	// Chưa có instance (vd: lúc load proxy_str rỗng) thì khởi động instance mới
+	// (có MaxInstances/InstanceIdleTTL thì instance được khởi động khi cấp phát, xem ensureInstance)
+	if err := GetDumbProxyManager().UpdateUpstream(proxyID, newProxyStr); err != nil {
+		if GetDumbProxyManager().lazyInstances() {
+			return
+		}
+		if _, err := GetDumbProxyManager().StartInstance(proxyID, newProxyStr); err != nil {
+			pm.logf("[DumbProxy] Failed to restart instance for proxy %d: %v\n", proxyID, err)
+		}
+	}
+}
+
+// resumeDumbProxyInstance khởi động lại instance đã bị dừng do đổi IP thất bại (mobilehop),
+// không làm gì nếu instance đang chạy
+func (pm *ProxyManager) resumeDumbProxyInstance(proxyID int64, proxyStr string) {
+	if _, ok := GetDumbProxyManager().GetAddress(proxyID); ok {
+		return
+	}
+	pm.restartDumbProxyInstance(proxyID, proxyStr)
 }
 
-// generateRandomString tạo chuỗi ngẫu nhiên với độ dài cho trước
+const (
+	// defaultStickyTokenLen độ dài mặc định của token thay cho {random}
+	defaultStickyTokenLen = 8
+	// defaultStickyTokenAlphabet bộ ký tự mặc định của token (hex)
+	defaultStickyTokenAlphabet = "0123456789abcdef"
+)
+
+// stickySessionPattern placeholder {session:N} hoặc ${session:N}: token N ký tự
+var stickySessionPattern = regexp.MustCompile(`\$?\{session:(\d+)\}`)
+
+// generateRandomString tạo chuỗi ngẫu nhiên (hex) với độ dài cho trước
 func generateRandomString(length int) string {
-	bytes := make([]byte, length/2)
+	return generateToken(length, defaultStickyTokenAlphabet)
+}
+
+// generateToken tạo chuỗi ngẫu nhiên với độ dài và bộ ký tự cho trước
+func generateToken(length int, alphabet string) string {
+	if alphabet == "" {
+		alphabet = defaultStickyTokenAlphabet
+	}
+	bytes := make([]byte, length)
 	if _, err := rand.Read(bytes); err != nil {
 		// Fallback nếu crypto/rand lỗi
-		return hex.EncodeToString([]byte(fmt.Sprintf("%d", time.Now().UnixNano())))[:length]
+		seed := hex.EncodeToString([]byte(fmt.Sprintf("%d", time.Now().UnixNano())))
+		copy(bytes, seed)
+	}
+	token := make([]byte, length)
+	for i, b := range bytes {
+		token[i] = alphabet[int(b)%len(alphabet)]
 	}
-	return hex.EncodeToString(bytes)[:length]
+	return string(token)
 }
 
 // processStickyProxyStr xử lý proxy string cho sticky type, thay thế {random} hoặc ${random} bằng chuỗi ngẫu nhiên
+// Dùng độ dài/bộ ký tự mặc định (8 ký tự hex)
 func processStickyProxyStr(proxyStr string) string {
-	// Format: ip:port:username:password
-	// Username có thể chứa {random} hoặc ${random} cần thay thế
-	parts := strings.Split(proxyStr, ":")
-	if len(parts) >= 3 {
-		username := parts[2]
-		// Thay thế ${random} hoặc {random} bằng chuỗi ngẫu nhiên 8 ký tự
-		if strings.Contains(username, "${random}") || strings.Contains(username, "{random}") {
-			randomStr := generateRandomString(8)
-			username = strings.ReplaceAll(username, "${random}", randomStr)
-			username = strings.ReplaceAll(username, "{random}", randomStr)
-			parts[2] = username
-			return strings.Join(parts, ":")
+	return processStickyProxyStrWith(proxyStr, defaultStickyTokenLen, defaultStickyTokenAlphabet)
+}
+
+// processStickyProxyStrWith thay thế placeholder bằng token ngẫu nhiên
+// - {random} hoặc ${random} trong username/password: token tokenLen ký tự
+// - {session:N} hoặc ${session:N}: token N ký tự
+// Các placeholder giống nhau trong cùng 1 string dùng chung 1 token
+func processStickyProxyStrWith(proxyStr string, tokenLen int, alphabet string) string {
+	return expandStickyPlaceholders(proxyStr, tokenLen, func(length int) string {
+		return generateToken(length, alphabet)
+	})
+}
+
+// expandStickyPlaceholders thay thế placeholder bằng token do newToken sinh ra
+func expandStickyPlaceholders(proxyStr string, tokenLen int, newToken func(length int) string) string {
+	if tokenLen <= 0 {
+		tokenLen = defaultStickyTokenLen
+	}
+
+	// {session:N} chứa ":" nên phải thay thế trước khi tách proxy string
+	if stickySessionPattern.MatchString(proxyStr) {
+		tokens := make(map[int]string)
+		proxyStr = stickySessionPattern.ReplaceAllStringFunc(proxyStr, func(m string) string {
+			n, _ := strconv.Atoi(stickySessionPattern.FindStringSubmatch(m)[1])
+			if _, ok := tokens[n]; !ok {
+				tokens[n] = newToken(n)
+			}
+			return tokens[n]
+		})
+	}
+
+	// Format: ip:port:username:password (password có thể chứa ":")
+	// Username và password có thể chứa {random} hoặc ${random} cần thay thế (dùng chung 1 token)
+	parts := strings.SplitN(proxyStr, ":", 4)
+	if len(parts) < 3 {
+		return proxyStr
+	}
+	var randomStr string
+	for i := 2; i < len(parts); i++ {
+		if !strings.Contains(parts[i], "{random}") {
+			continue
+		}
+		if randomStr == "" {
+			randomStr = newToken(tokenLen)
+		}
+		parts[i] = strings.ReplaceAll(parts[i], "${random}", randomStr)
+		parts[i] = strings.ReplaceAll(parts[i], "{random}", randomStr)
+	}
+	if randomStr == "" {
+		return proxyStr
+	}
+	return strings.Join(parts, ":")
+}
+
+// effectiveMinTime min_time của proxy cộng jitter (RotationJitter)
+// Jitter tính từ id + last_changed nên cố định trong 1 chu kỳ đổi IP (không random lại mỗi lần kiểm tra)
+func (pm *ProxyManager) effectiveMinTime(p *Proxy) time.Duration {
+	minTime := time.Duration(p.MinTime) * time.Second
+	if minTime <= 0 || pm.rotationJitter <= 0 {
+		return minTime
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d", p.ID, p.LastChanged.Unix())))
+	n := binary.BigEndian.Uint64(sum[:8])
+	return minTime + time.Duration(n%uint64(pm.rotationJitter))
+}
+
+// minTimeElapsed proxy đã qua min_time (kèm jitter) kể từ lần đổi IP cuối, hoặc IP sắp hết hạn
+func (pm *ProxyManager) minTimeElapsed(p *Proxy, now time.Time) bool {
+	return p.MinTime == 0 || now.Sub(p.LastChanged) >= pm.effectiveMinTime(p) || ipExpiringSoon(p.IPExpiresAt, now)
+}
+
+// jitterDelayed proxy được điều kiện SQL của getAvailableProxy chọn vì đã qua min_time gốc
+// nhưng đã hết MaxUsed và chưa qua min_time + jitter: chưa được cấp phát (jitter chỉ làm chậm, không rút ngắn)
+func (pm *ProxyManager) jitterDelayed(p *Proxy, now time.Time) bool {
+	if pm.rotationJitter <= 0 || !p.Unique || p.Used < pm.maxUsed {
+		return false
+	}
+	switch p.Type {
+	case ProxyTypeStatic, ProxyTypeMobileHop, ProxyTypeAuto:
+		return false
+	}
+	if p.Type == ProxyTypeSticky && p.FreshSessionEachUse {
+		return false
+	}
+	return !pm.minTimeElapsed(p, now)
+}
+
+// deterministicToken sinh token cố định từ seed (cùng seed + length luôn cho cùng token)
+func deterministicToken(seed string, length int, alphabet string) string {
+	if alphabet == "" {
+		alphabet = defaultStickyTokenAlphabet
+	}
+	token := make([]byte, 0, length)
+	for block := 0; len(token) < length; block++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", seed, length, block)))
+		for _, b := range sum {
+			if len(token) == length {
+				break
+			}
+			token = append(token, alphabet[int(b)%len(alphabet)])
 		}
 	}
-	return proxyStr
+	return string(token)
+}
+
+// expandStickyProxyStr thay thế placeholder theo cấu hình StickyTokenLen/StickyTokenAlphabet
+// Nếu bật StickySessionPerThread, token được sinh cố định theo (proxyID, threadId) cho tới khi RotateStickySession
+func (pm *ProxyManager) expandStickyProxyStr(proxyID int64, threadId int, proxyStr string) string {
+	if !pm.stickySessionPerThread {
+		return processStickyProxyStrWith(proxyStr, pm.stickyTokenLen, pm.stickyTokenAlphabet)
+	}
+
+	pm.sessionMu.Lock()
+	generation := pm.threadSessionGen[threadId]
+	pm.sessionMu.Unlock()
+
+	seed := fmt.Sprintf("%s|%d|%d|%d", pm.sessionSalt, proxyID, threadId, generation)
+	return expandStickyPlaceholders(proxyStr, pm.stickyTokenLen, func(length int) string {
+		return deterministicToken(seed, length, pm.stickyTokenAlphabet)
+	})
+}
+
+// RotateStickySession buộc thread nhận session (token) mới cho các sticky proxy ở lần lấy tiếp theo
+// Chỉ có tác dụng khi bật Config.StickySessionPerThread
+func (pm *ProxyManager) RotateStickySession(threadId int) {
+	pm.sessionMu.Lock()
+	defer pm.sessionMu.Unlock()
+	pm.threadSessionGen[threadId]++
 }
 
 func (pm *ProxyManager) ReleaseProxy(id int64) error {
+	threadId, prefetch := pm.releaseProxy(id)
+
+	// PrefetchPerThread: lấy sẵn proxy tiếp theo cho thread vừa release
+	if prefetch && threadId.Valid {
+		pm.prefetchStandby(int(threadId.Int64))
+	}
+	return nil
+}
+
+// releaseProxy set running=false cho proxy, trả về thread đang giữ proxy và cờ PrefetchPerThread
+func (pm *ProxyManager) releaseProxy(id int64) (threadId sql.NullInt64, prefetch bool) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
+	// Lấy thread đang giữ proxy trước khi clear
+	pm.db.QueryRow(`SELECT thread_id FROM proxies WHERE id=?`, id).Scan(&threadId)
+
 	now := time.Now()
-	pm.db.Exec(`UPDATE proxies SET running=false, thread_id=NULL, updated_at=? WHERE id=?`, now, id)
+	pm.db.Exec(`UPDATE proxies SET running=false, thread_id=NULL, running_since=NULL, updated_at=? WHERE id=?`, now, id)
 	if p, ok := pm.proxyCache[id]; ok {
-		p.Running, p.UpdatedAt = false, now
+		p.Running, p.RunningSince, p.UpdatedAt = false, time.Time{}, now
 	}
-	return nil
+	if pm.trackUsage {
+		pm.db.Exec(`UPDATE proxy_usage SET released_at=? WHERE proxy_id=? AND released_at IS NULL`, now.Unix(), id)
+	}
+	pm.notifyRelease()
+	return threadId, pm.prefetchPerThread
+}
+
+// claimProxy giữ proxy đang rảnh (running=0 -> 1) cho thao tác nội bộ như đổi IP (EvictExpired, RotateAllEligible)
+// để proxy không bị cấp phát giữa chừng. Trả về false nếu proxy đang được sử dụng (hoặc đã bị thao tác khác giữ)
+func (pm *ProxyManager) claimProxy(id int64) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	now := time.Now()
+	result, err := pm.db.Exec(`UPDATE proxies SET running=1, running_since=?, updated_at=? WHERE id=? AND running=0`, now.Unix(), now, id)
+	if err != nil {
+		return false
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false
+	}
+	if p, ok := pm.proxyCache[id]; ok {
+		p.Running, p.RunningSince, p.UpdatedAt = true, time.Unix(now.Unix(), 0), now
+	}
+	return true
+}
+
+// unclaimProxy trả proxy đã claimProxy về pool
+func (pm *ProxyManager) unclaimProxy(id int64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	now := time.Now()
+	pm.db.Exec(`UPDATE proxies SET running=0, running_since=NULL, updated_at=? WHERE id=?`, now, id)
+	if p, ok := pm.proxyCache[id]; ok {
+		p.Running, p.RunningSince, p.UpdatedAt = false, time.Time{}, now
+	}
+	pm.notifyRelease()
+}
+
+// LoadResult báo cáo kết quả LoadProxiesFromList
+type LoadResult struct {
+	NewIDs            []int64  // proxy thêm mới
+	UpdatedIDs        []int64  // proxy đã có trong db (cùng unique_key), được cập nhật
+	SkippedDuplicates []string // dòng bị dòng sau cùng unique_key trong cùng danh sách thay thế (dòng cuối cùng được dùng), bị bỏ qua
+	Evicted           []int64  // proxy cũ bị xoá để pool không vượt quá Config.MaxPoolSize
 }
 
-func (pm *ProxyManager) LoadProxiesFromList(proxyStrings []string) ([]int64, error) {
+// LoadProxiesFromList load danh sách proxy vào db, upsert theo unique_key
+// Trả về id của các proxy đã load (theo thứ tự, không gồm dòng trùng/lỗi), báo cáo mới/cập nhật/trùng
+// và lỗi của từng dòng (LineError.Line là vị trí trong proxyStrings, bắt đầu từ 1).
+// Dòng sai format/loại proxy không làm dừng cả danh sách, các dòng hợp lệ vẫn được load
+func (pm *ProxyManager) LoadProxiesFromList(proxyStrings []string) ([]int64, LoadResult, []LineError) {
 	var ids []int64
+	var result LoadResult
+	var errs []LineError
+	seen := make(map[string]int) // unique_key đã gặp trong danh sách -> vị trí trong pending
+
+	// IP public của máy, chỉ detect khi cần (tmproxy có ip_allow) và 1 lần cho cả danh sách
+	var detectedIP string
+	var detectOnce sync.Once
+	publicIP := func() string {
+		detectOnce.Do(func() {
+			ip, err := DetectPublicIP(context.Background())
+			if err != nil {
+				pm.logf("[ProxyManager] Failed to detect public IP: %v\n", err)
+			}
+			detectedIP = ip
+		})
+		return detectedIP
+	}
+
+	lineError := func(i int, s string, err error) {
+		errs = append(errs, LineError{Line: i + 1, Input: s, Err: err})
+	}
 
-	for _, s := range proxyStrings {
+	var pending []*loadEntry
+entries:
+	for i, s := range proxyStrings {
 		parts := strings.Split(strings.TrimSpace(s), "|")
 		if len(parts) < 2 {
-			return nil, fmt.Errorf("invalid format: %s", s)
+			lineError(i, s, errors.New("invalid format: expected type|proxy_str or type|api_key"))
+			continue
 		}
 
 		pType := ProxyType(parts[0])
 		if err := pm.validateProxyType(pType); err != nil {
-			return nil, err
+			lineError(i, s, err)
+			continue
+		}
+
+		// Cờ tuỳ chọn (ở vị trí bất kỳ sau proxy_str/api key):
+		// - "fresh" (sticky): tạo session mới mỗi lần lấy, vd: sticky|host:port:user-{random}:pass|true|fresh
+		// - "parallel" (tmproxy/kiotproxy/ipv4xoay): api key cho phép nhiều session song song (dùng cho ProactiveRotation)
+		// - "socks5" (tmproxy/kiotproxy/ipv4xoay): dùng proxy SOCKS5 của provider (kèm user/pass) thay cho HTTP,
+		//   proxy_str dạng socks5://host:port:user:pass
+		// - "location=N", "isp=N" (tmproxy): id_location/id_isp khi GetNewProxy, vd: tmproxy|api_key|370|location=1|isp=2
+		// - "nhamang=NAME", "tinhthanh=N" (ipv4xoay): nhà mạng/tỉnh thành khi lấy proxy, vd: ipv4xoay|api_key|60|nhamang=viettel|tinhthanh=1
+		// - "method=M", "header=Name: value" (lặp lại được), "body=..." (mobilehop): request gọi change_url,
+		//   vd: mobilehop|host:port:user:pass|https://api/change|method=POST|header=Authorization: Bearer xxx
+		// - "tag=NAME" (mọi loại, lặp lại được): nhóm proxy cho GetAvailableProxyByTag, vd: static|host:port:user:pass|tag=us|tag=residential
+		// - "weight=N" (mọi loại, N > 0, mặc định 1): trọng số khi chọn proxy với StrategyWeightedRandom, vd: static|host:port:user:pass|weight=3
+		freshSession, parallelSessions, socks5 := false, false, false
+		weight := 1.0
+		var changeRequest ChangeRequest
+		var tags []string
+		kept := parts[:2]
+		for _, part := range parts[2:] {
+			if value, ok := strings.CutPrefix(part, "tag="); ok {
+				tag := normalizeTag(value)
+				if tag == "" || strings.Contains(tag, ",") {
+					lineError(i, s, fmt.Errorf("invalid tag: %s", part))
+					continue entries
+				}
+				tags = append(tags, tag)
+				continue
+			}
+			if value, ok := strings.CutPrefix(part, "weight="); ok {
+				w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || math.IsNaN(w) || w <= 0 || math.IsInf(w, 0) {
+					lineError(i, s, fmt.Errorf("invalid weight: %s", part))
+					continue entries
+				}
+				weight = w
+				continue
+			}
+			if pType == ProxyTypeMobileHop {
+				if name, value, ok := strings.Cut(part, "="); ok && (name == "method" || name == "header" || name == "body") {
+					switch name {
+					case "method":
+						changeRequest.Method = strings.ToUpper(strings.TrimSpace(value))
+					case "body":
+						changeRequest.Body = value
+					case "header":
+						key, val, ok := strings.Cut(value, ":")
+						if !ok || strings.TrimSpace(key) == "" {
+							// Không đưa value vào lỗi: có thể là token (vd: "header=Bearer xxx" thiếu tên header)
+							lineError(i, s, errors.New("invalid header: expected header=Name: value"))
+							continue entries
+						}
+						if changeRequest.Headers == nil {
+							changeRequest.Headers = make(map[string]string)
+						}
+						changeRequest.Headers[strings.TrimSpace(key)] = strings.TrimSpace(val)
+					}
+					continue
+				}
+			}
+			if part == "fresh" && pType == ProxyTypeSticky {
+				freshSession = true
+				continue
+			}
+			if part == "parallel" && isProviderType(pType) {
+				parallelSessions = true
+				continue
+			}
+			if part == "socks5" && isProviderType(pType) {
+				socks5 = true
+				continue
+			}
+			kept = append(kept, part)
+		}
+		parts = kept
+
+		// Tuỳ chọn riêng của provider (vd: location=/isp= của tmproxy, region= của kiotproxy)
+		var providerOpts ProviderOptions
+		provider, isProvider := getProvider(pType)
+		if isProvider {
+			opts, rest, err := provider.ParseConfig(parts[2:])
+			if err != nil {
+				lineError(i, s, err)
+				continue
+			}
+			providerOpts = opts
+			providerOpts.SOCKS5 = socks5
+			parts = append(parts[:2:2], rest...)
 		}
 
 		var proxyStr, apiKey string
 		changeUrl := ""
 		minTime := 0
+		minTimeSet := false // dòng có min_time (kể cả 0), ngược lại dùng Config.DefaultMinTimes
 		unique := false
+		parseMinTime := func(s string) bool {
+			val, err := strconv.Atoi(s)
+			if err != nil || val < 0 {
+				return false
+			}
+			minTime, minTimeSet = val, true
+			return true
+		}
 
 		// Xác định unique theo loại proxy
 		// tmproxy, mobilehop, static, kiotproxy, auto, ipv4xoay: unique = true
 		// sticky: có thể truyền true/false, default = false
-		if pType == ProxyTypeTMProxy || pType == ProxyTypeMobileHop || pType == ProxyTypeStatic || pType == ProxyTypeKiotProxy || pType == ProxyTypeAuto || pType == ProxyTypeIPv4Xoay {
+		if isProvider || pType == ProxyTypeMobileHop || pType == ProxyTypeStatic || pType == ProxyTypeAuto {
 			unique = true
 		}
 
+		// Api key dạng $NAME/${NAME} đọc từ biến môi trường (chỉ áp dụng cho trường api key, không cho cả dòng)
+		key, err := expandAPIKey(parts[1])
+		if err != nil {
+			lineError(i, s, err)
+			continue
+		}
+		parts[1] = key
+
 		if strings.Contains(parts[1], ":") {
 			proxyStr = parts[1]
 		} else {
@@ -177,261 +623,381 @@ func (pm *ProxyManager) LoadProxiesFromList(proxyStrings []string) ([]int64, err
 				unique = parts[2] == "true"
 				// Check parts[3] và parts[4] cho minTime/changeUrl
 				if len(parts) > 3 && parts[3] != "" {
-					if val, _ := strconv.Atoi(parts[3]); val > 0 {
-						minTime = val
+					if parseMinTime(parts[3]) {
 						if len(parts) > 4 {
 							changeUrl = parts[4]
 						}
 					} else {
 						changeUrl = parts[3]
 						if len(parts) > 4 {
-							if val, _ := strconv.Atoi(parts[4]); val > 0 {
-								minTime = val
-							}
+							parseMinTime(parts[4])
 						}
 					}
 				}
 			} else if pType != ProxyTypeMobileHop {
 				// Không phải mobilehop và không phải sticky unique flag: xử lý minTime/changeUrl
-				if val, _ := strconv.Atoi(parts[2]); val > 0 {
-					minTime = val
+				if parseMinTime(parts[2]) {
 					if len(parts) > 3 {
 						changeUrl = parts[3]
 					}
 				} else {
 					changeUrl = parts[2]
 					if len(parts) > 3 {
-						if val, _ := strconv.Atoi(parts[3]); val > 0 {
-							minTime = val
-						}
+						parseMinTime(parts[3])
 					}
 				}
 			}
 		}
 
-		// Biến để tính lastChanged và error cho từng loại proxy
-		var lastChanged time.Time
-		var proxyError string
-
-		// TMProxy: lấy proxy từ API
-		if pType == ProxyTypeTMProxy && apiKey != "" {
-			resp, err := service.GetTMProxy().GetCurrentProxy(apiKey)
-			needGetNew := false
-			var currentProxyErr error
-
-			if err != nil {
-				currentProxyErr = err
-				needGetNew = true
-			} else if resp == nil {
-				currentProxyErr = fmt.Errorf("GetCurrentProxy returned nil response")
-				needGetNew = true
-			} else if resp.Code != 0 {
-				currentProxyErr = fmt.Errorf("code: %d, message: %s", resp.Code, resp.Message)
-				needGetNew = true
-			} else if resp.Data.Timeout == 0 || resp.Data.NextRequest == 0 {
-				// Timeout == 0 hoặc đủ điều kiện thay IP (NextRequest == 0) → GetNewProxy
-				needGetNew = true
-			} else {
-				// Có proxy nhưng chưa đủ điều kiện thay (NextRequest > 0)
-				// NextRequest = số giây còn lại trước khi refresh được IP
-				proxyStr = fmt.Sprintf("%s:%s:%s", resp.Data.HTTPS, resp.Data.Username, resp.Data.Password)
-
-				// Tính lastChanged: now - (minTime - NextRequest)
-				// Ví dụ: minTime=360s, NextRequest=120s → lastChanged = now - 240s
-				waitSeconds := minTime - resp.Data.NextRequest
-				if waitSeconds < 0 {
-					waitSeconds = 0
-				}
-				lastChanged = time.Now().Add(-time.Duration(waitSeconds) * time.Second)
-			}
-
-			if needGetNew {
-				newResp, err := service.GetTMProxy().GetNewProxy(apiKey, 0, 0)
-				if err != nil {
-					proxyError = fmt.Sprintf("GetNewProxy failed: %v", err)
-					lastChanged = time.Now()
-				} else if newResp == nil {
-					proxyError = "GetNewProxy returned nil response"
-					lastChanged = time.Now()
-				} else if newResp.Code != 0 {
-					proxyError = fmt.Sprintf("GetNewProxy failed - code: %d, message: %s", newResp.Code, newResp.Message)
-					lastChanged = time.Now()
-				} else {
-					proxyStr = fmt.Sprintf("%s:%s:%s", newResp.Data.HTTPS, newResp.Data.Username, newResp.Data.Password)
-					lastChanged = time.Now()
-				}
-
-				// Nếu GetNewProxy thất bại nhưng GetCurrentProxy có lỗi, ghi lỗi GetCurrentProxy
-				if proxyError == "" && currentProxyErr != nil {
-					// GetNewProxy thành công, không cần ghi lỗi
-				}
-			}
+		// Dòng không có min_time: dùng min_time mặc định của loại proxy (min_time của dòng, kể cả 0, luôn được ưu tiên)
+		if !minTimeSet {
+			minTime = pm.defaultMinTimes[pType]
 		}
 
-		// KiotProxy: lấy proxy từ API
-		if pType == ProxyTypeKiotProxy && apiKey != "" {
-			// Parse region từ parts nếu có (có thể ở vị trí 3 hoặc 4)
-			// Lưu region vào changeUrl để dùng sau này
-			if len(parts) > 3 && parts[3] != "" && !strings.Contains(parts[3], "://") {
-				// Kiểm tra xem có phải là số không (minTime)
-				if val, _ := strconv.Atoi(parts[3]); val == 0 {
-					changeUrl = parts[3] // region
-				} else if len(parts) > 4 {
-					changeUrl = parts[4] // region
-				}
-			}
-
-			region := changeUrl
-			resp, err := service.GetKiotProxy().GetCurrentProxy(apiKey)
-			needGetNew := false
-			nowUnix := time.Now().Unix()
+		uniqueKey := proxyUniqueKey(pType, parts[1])
 
-			if err != nil {
-				needGetNew = true
-			} else if resp == nil {
-				needGetNew = true
-			} else if !resp.Success {
-				needGetNew = true
-			} else {
-				// NextRequestAt là Unix timestamp (milliseconds), chia 1000 để ra seconds
-				nextRequestAtUnix := resp.Data.NextRequestAt / 1000
-				if nextRequestAtUnix <= nowUnix {
-					// Đủ điều kiện thay IP → GetNewProxy
-					needGetNew = true
-				} else {
-					// Có proxy nhưng chưa đủ điều kiện thay
-					proxyStr = resp.Data.HTTP
-
-					// Tính lastChanged: còn bao nhiêu giây phải đợi
-					remainingSeconds := int(nextRequestAtUnix - nowUnix)
-
-					// lastChanged = now - (minTime - remaining)
-					waitSeconds := minTime - remainingSeconds
-					if waitSeconds < 0 {
-						waitSeconds = 0
-					}
-					lastChanged = time.Now().Add(-time.Duration(waitSeconds) * time.Second)
-				}
-			}
-
-			if needGetNew {
-				newResp, err := service.GetKiotProxy().GetNewProxy(apiKey, region)
-				if err != nil {
-					proxyError = fmt.Sprintf("GetNewProxy failed: %v", err)
-					lastChanged = time.Now()
-				} else if newResp == nil {
-					proxyError = "GetNewProxy returned nil response"
-					lastChanged = time.Now()
-				} else if !newResp.Success {
-					proxyError = fmt.Sprintf("GetNewProxy failed - code: %d, message: %s, error: %s", newResp.Code, newResp.Message, newResp.Error)
-					lastChanged = time.Now()
-				} else {
-					proxyStr = newResp.Data.HTTP
-					lastChanged = time.Now()
-				}
-			}
+		entry := &loadEntry{
+			line: i, input: s, pType: pType, proxyStr: proxyStr, apiKey: apiKey, changeUrl: changeUrl,
+			minTime: minTime, uniqueKey: uniqueKey, unique: unique, freshSession: freshSession,
+			parallelSessions: parallelSessions, weight: weight, changeRequest: changeRequest, tags: tags,
+			provider: provider, providerOpts: providerOpts,
 		}
 
-		// IPv4Xoay: lấy proxy từ API (phương án 3: retry tự động nếu bị block)
-		if pType == ProxyTypeIPv4Xoay && apiKey != "" {
-			resp, err := service.GetIPv4Xoay().GetCurrentProxy(apiKey)
-
-			if err != nil {
-				// Lỗi network hoặc parsing
-				proxyError = fmt.Sprintf("GetCurrentProxy failed: %v", err)
-				lastChanged = time.Now()
-			} else if resp == nil {
-				// Status 101 (bị block): phương án 3 - không set error, thử lại sau
-				// Không set proxyError, sẽ để proxy có cơ hội thử lại
-				// Giữ proxyStr trống, sẽ xử lý khi GetAvailableProxy
-				lastChanged = time.Now()
-			} else {
-				// Status 100: thành công
-				proxyStr = resp.ProxyHTTP
-				lastChanged = time.Now()
-			}
+		// Proxy trùng với dòng trước đó trong cùng danh sách: dòng sau thay thế dòng trước (giữ vị trí của dòng trước)
+		// như upsert tuần tự, api key chỉ được gọi API provider 1 lần
+		if idx, ok := seen[uniqueKey]; ok {
+			result.SkippedDuplicates = append(result.SkippedDuplicates, pending[idx].input)
+			pending[idx] = entry
+			continue
 		}
+		seen[uniqueKey] = len(pending)
+		pending = append(pending, entry)
+	}
 
-		// Sticky: lưu proxyStr gốc (có ${random}), sẽ xử lý khi GetAvailableProxy
+	// Provider (tmproxy/kiotproxy/ipv4xoay/...): gọi API song song (tối đa loadConcurrency api key cùng lúc)
+	// Dòng trùng api key đã bị thay thế ở trên (cùng unique_key) nên mỗi api key chỉ được gọi 1 lần
+	sem := make(chan struct{}, loadConcurrency)
+	var wg sync.WaitGroup
+	for _, e := range pending {
+		if e.provider == nil || e.apiKey == "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e *loadEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			pm.loadFromProvider(e, publicIP)
+		}(e)
+	}
+	wg.Wait()
 
+	// Ghi vào db tuần tự theo thứ tự các dòng
+	for _, e := range pending {
 		// Với các loại proxy khác (static, sticky, mobilehop), lastChanged = now
-		if lastChanged.IsZero() {
-			lastChanged = time.Now()
+		// Sticky: lưu proxyStr gốc (có ${random}), sẽ xử lý khi GetAvailableProxy
+		if e.lastChanged.IsZero() {
+			e.lastChanged = time.Now()
 		}
 
-		// Tính uniqueKey: MD5 hash của apiKey (tmproxy/kiotproxy/ipv4xoay) hoặc proxyStr (static/mobilehop/sticky)
-		var uniqueKey string
-		if pType == ProxyTypeTMProxy || pType == ProxyTypeKiotProxy || pType == ProxyTypeIPv4Xoay {
-			uniqueKey = fmt.Sprintf("%x", md5.Sum([]byte(apiKey)))
+		id, inserted, err := pm.upsertProxy(e.pType, e.proxyStr, e.apiKey, e.changeUrl, e.minTime, e.uniqueKey, e.unique, e.lastChanged, e.proxyError)
+		if err != nil {
+			lineError(e.line, e.input, err)
+			continue
+		}
+		if inserted {
+			result.NewIDs = append(result.NewIDs, id)
 		} else {
-			// Với sticky, dùng proxyStr gốc (chưa thay ${random}) để tính uniqueKey
-			if pType == ProxyTypeSticky {
-				// Lấy proxyStr gốc từ parts[1]
-				originalProxyStr := parts[1]
-				uniqueKey = fmt.Sprintf("%x", md5.Sum([]byte(originalProxyStr)))
-			} else {
-				uniqueKey = fmt.Sprintf("%x", md5.Sum([]byte(proxyStr)))
+			result.UpdatedIDs = append(result.UpdatedIDs, id)
+		}
+		if !e.meta.isZero() {
+			pm.saveProxyMeta(id, e.meta)
+		}
+		if e.pType == ProxyTypeSticky {
+			pm.db.Exec(`UPDATE proxies SET fresh_session=? WHERE id=?`, e.freshSession, id)
+			if cached, ok := pm.proxyCache[id]; ok {
+				cached.FreshSessionEachUse = e.freshSession
 			}
 		}
-
-		id, err := pm.upsertProxy(pType, proxyStr, apiKey, changeUrl, minTime, uniqueKey, unique, lastChanged, proxyError)
-		if err != nil {
-			return nil, err
+		pm.db.Exec(`UPDATE proxies SET tags=?, weight=? WHERE id=?`, encodeTags(e.tags), e.weight, id)
+		if cached, ok := pm.proxyCache[id]; ok {
+			cached.Tags = decodeTags(encodeTags(e.tags))
+			cached.Weight = e.weight
+		}
+		if e.pType == ProxyTypeMobileHop {
+			pm.db.Exec(`UPDATE proxies SET change_request=? WHERE id=?`, encodeChangeRequest(e.changeRequest), id)
+			if cached, ok := pm.proxyCache[id]; ok {
+				cached.ChangeRequest = e.changeRequest
+			}
+		}
+		if e.provider != nil {
+			pm.db.Exec(`UPDATE proxies SET id_location=?, id_isp=?, nhamang=?, tinhthanh=?, parallel_sessions=?, socks5=? WHERE id=?`,
+				e.providerOpts.IDLocation, e.providerOpts.IDISP, e.providerOpts.NhaMang, e.providerOpts.TinhThanh, e.parallelSessions, e.providerOpts.SOCKS5, id)
+			if cached, ok := pm.proxyCache[id]; ok {
+				cached.IDLocation = e.providerOpts.IDLocation
+				cached.IDISP = e.providerOpts.IDISP
+				cached.NhaMang = e.providerOpts.NhaMang
+				cached.TinhThanh = e.providerOpts.TinhThanh
+				cached.ParallelSessions = e.parallelSessions
+				cached.SOCKS5 = e.providerOpts.SOCKS5
+			}
+		}
+		pm.metrics.load(e.pType)
+		if e.proxyError != "" {
+			pm.logf("[ProxyManager] Proxy %d (%s): %s\n", id, e.pType, e.proxyError)
+			pm.metrics.apiFailure(e.pType)
 		}
 
 		ids = append(ids, id)
 	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
 
-	return ids, nil
+	if pm.maxPoolSize > 0 {
+		result.Evicted = pm.evictOverflowLocked(ids)
+	}
+
+	if len(result.SkippedDuplicates) > 0 {
+		pm.logf("[ProxyManager] Skipped %d duplicate proxy strings\n", len(result.SkippedDuplicates))
+	}
+
+	return ids, result, errs
 }
 
-func (pm *ProxyManager) upsertProxy(pType ProxyType, proxyStr, apiKey, changeUrl string, minTime int, uniqueKey string, unique bool, lastChanged time.Time, proxyError string) (int64, error) {
-	now := time.Now()
+// loadConcurrency số api key được gọi API provider cùng lúc khi load danh sách proxy
+const loadConcurrency = 8
+
+// loadEntry 1 dòng proxy hợp lệ trong LoadProxiesFromList, chờ gọi provider và ghi vào db
+type loadEntry struct {
+	line             int // vị trí trong danh sách (bắt đầu từ 0)
+	input            string
+	pType            ProxyType
+	proxyStr         string
+	apiKey           string
+	changeUrl        string
+	minTime          int
+	uniqueKey        string
+	unique           bool
+	freshSession     bool
+	parallelSessions bool
+	weight           float64
+	changeRequest    ChangeRequest
+	tags             []string
+	provider         Provider // nil nếu không phải loại provider
+	providerOpts     ProviderOptions
+
+	// Kết quả gọi provider
+	lastChanged time.Time
+	proxyError  string
+	meta        providerMeta // Thông tin location/isp/expiration từ provider
+}
 
-	result, err := pm.db.Exec(
-		`INSERT INTO proxies (type, proxy_str, api_key, unique_key, min_time, change_url, is_unique, last_changed, error, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		pType, proxyStr, apiKey, uniqueKey, minTime, changeUrl, unique, lastChanged.Unix(), proxyError, now, now,
-	)
+// loadFromProvider dùng proxy hiện tại của api key, lấy IP mới nếu chưa có hoặc đã đủ điều kiện thay IP
+// Chỉ ghi vào e (không đụng db/cache), an toàn khi chạy song song cho nhiều dòng
+func (pm *ProxyManager) loadFromProvider(e *loadEntry, publicIP func() string) {
+	// Region lưu vào changeUrl để dùng khi rotate
+	if e.providerOpts.Region != "" {
+		e.changeUrl = e.providerOpts.Region
+	} else {
+		e.providerOpts.Region = e.changeUrl
+	}
 
-	if err == nil {
-		id, _ := result.LastInsertId()
-		pm.proxyCache[id] = &Proxy{
-			ID:          id,
-			Type:        pType,
-			ProxyStr:    proxyStr,
-			ApiKey:      apiKey,
-			ChangeUrl:   changeUrl,
-			MinTime:     minTime,
-			Running:     false,
-			Used:        0,
-			Unique:      unique,
-			LastChanged: lastChanged,
-			Error:       proxyError,
-			CreatedAt:   now,
-			UpdatedAt:   now,
-		}
-		return id, nil
+	ctx := pm.baseContext()
+	res, err := e.provider.GetCurrent(ctx, e.apiKey, e.providerOpts)
+	fresh := false
+	if errors.Is(err, ErrNoCurrentProxy) {
+		res, err = e.provider.GetNew(ctx, e.apiKey, e.providerOpts)
+		fresh = true
 	}
 
-	if !strings.Contains(err.Error(), "UNIQUE") {
-		return 0, err
+	e.lastChanged = time.Now()
+	switch {
+	case errors.Is(err, ErrProviderBlocking):
+		// Provider tạm thời chặn (vd: ipv4xoay status 101): không set error, thử lại sau
+		// Giữ proxyStr trống, sẽ xử lý khi GetAvailableProxy
+	case err != nil:
+		e.proxyError = err.Error()
+	default:
+		proxyStr, err := res.connectionString(e.providerOpts.SOCKS5)
+		if err != nil {
+			e.proxyError = err.Error()
+			return
+		}
+		e.proxyStr = proxyStr
+		e.meta = res.meta()
+
+		// Proxy hiện tại chưa đủ điều kiện thay: lastChanged = now - (minTime - số giây còn lại)
+		// Ví dụ: minTime=360s, còn 120s → lastChanged = now - 240s
+		if !fresh && !res.NextChangeAt.IsZero() {
+			remaining := int(time.Until(res.NextChangeAt).Round(time.Second) / time.Second)
+			waitSeconds := e.minTime - remaining
+			if waitSeconds < 0 {
+				waitSeconds = 0
+			}
+			e.lastChanged = e.lastChanged.Add(-time.Duration(waitSeconds) * time.Second)
+		}
+
+		// Kiểm tra IP hiện tại có trong ip_allow của api key không
+		if e.pType == ProxyTypeTMProxy && res.IPAllow != "" {
+			e.proxyError = pm.checkTMProxyIPAllow(e.apiKey, res.IPAllow, publicIP)
+		}
 	}
+}
 
-	pm.db.Exec(`UPDATE proxies SET proxy_str=?, min_time=?, change_url=?, is_unique=?, last_changed=?, error=?, updated_at=? WHERE unique_key=?`,
-		proxyStr, minTime, changeUrl, unique, lastChanged.Unix(), proxyError, now, uniqueKey)
+// expandAPIKey thay api key dạng $NAME hoặc ${NAME} bằng giá trị biến môi trường NAME, tránh ghi api key vào
+// file cấu hình/log. Giá trị không bắt đầu bằng "$" được giữ nguyên; biến chưa set (hoặc rỗng) trả về lỗi
+func expandAPIKey(value string) (string, error) {
+	name, ok := strings.CutPrefix(value, "$")
+	if !ok {
+		return value, nil
+	}
+	if braced, ok := strings.CutPrefix(name, "{"); ok {
+		name, ok = strings.CutSuffix(braced, "}")
+		if !ok {
+			return "", fmt.Errorf("invalid env reference: %s", value)
+		}
+	}
+	if !envNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid env reference: %s", value)
+	}
+	key := os.Getenv(name)
+	if key == "" {
+		return "", fmt.Errorf("api key env %s is not set", name)
+	}
+	return key, nil
+}
 
-	var id int64
-	pm.db.QueryRow(`SELECT id FROM proxies WHERE unique_key=?`, uniqueKey).Scan(&id)
+// envNameRe tên biến môi trường hợp lệ cho expandAPIKey
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
-	// Update hoặc tạo mới cache entry
-	if cached, ok := pm.proxyCache[id]; ok {
-		cached.ProxyStr = proxyStr
+// proxyUniqueKey tính unique_key từ phần thứ 2 của dòng proxy (proxy_str hoặc api key):
+// MD5 hash của apiKey (tmproxy/kiotproxy/ipv4xoay/...) hoặc proxyStr (static/mobilehop/sticky)
+func proxyUniqueKey(pType ProxyType, value string) string {
+	var proxyStr, apiKey string
+	if strings.Contains(value, ":") {
+		proxyStr = value
+	} else {
+		apiKey = value
+	}
+	if isProviderType(pType) {
+		return fmt.Sprintf("%x", md5.Sum([]byte(apiKey)))
+	}
+	// Với sticky, dùng proxyStr gốc (chưa thay ${random}) để tính uniqueKey
+	if pType == ProxyTypeSticky {
+		return fmt.Sprintf("%x", md5.Sum([]byte(value)))
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(proxyStr)))
+}
+
+// LineError lỗi của 1 dòng proxy khi load
+// Err không chứa nội dung dòng (có thể có user/pass, api key), Input là dòng gốc chưa che
+type LineError struct {
+	Line  int    // số dòng trong input (bắt đầu từ 1)
+	Input string // chuỗi proxy bị lỗi
+	Err   error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e LineError) Unwrap() error {
+	return e.Err
+}
+
+// proxyEntry 1 chuỗi proxy tách ra từ blob, kèm số dòng
+type proxyEntry struct {
+	line  int
+	input string
+}
+
+// splitProxyBlob tách blob thành danh sách chuỗi proxy: mỗi dòng 1 hoặc nhiều proxy cách nhau bởi dấu phẩy
+// Bỏ dòng trống, khoảng trắng thừa và dòng comment bắt đầu bằng #
+func splitProxyBlob(blob string) []proxyEntry {
+	var entries []proxyEntry
+	for i, line := range strings.Split(blob, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, s := range strings.Split(line, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				entries = append(entries, proxyEntry{line: i + 1, input: s})
+			}
+		}
+	}
+	return entries
+}
+
+// LoadProxiesFromString load proxy từ 1 đoạn text (mỗi dòng 1 proxy, hoặc nhiều proxy cách nhau bởi dấu phẩy),
+// bỏ qua dòng trống và dòng bắt đầu bằng #. Mỗi proxy được parse như LoadProxiesFromList
+// nên chuỗi proxy không được chứa dấu phẩy (vd: body của mobilehop), dùng LoadProxiesFromList cho trường hợp đó.
+// Dòng lỗi không làm dừng cả batch: trả về id của các proxy load được và lỗi của từng dòng (Line là số dòng trong blob)
+func (pm *ProxyManager) LoadProxiesFromString(blob string) ([]int64, []LineError) {
+	entries := splitProxyBlob(blob)
+	proxyStrings := make([]string, len(entries))
+	for i, entry := range entries {
+		proxyStrings[i] = entry.input
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	ids, _, errs := pm.LoadProxiesFromList(proxyStrings)
+	for i := range errs {
+		errs[i].Line = entries[errs[i].Line-1].line
+	}
+	return ids, errs
+}
+
+func (pm *ProxyManager) upsertProxy(pType ProxyType, proxyStr, apiKey, changeUrl string, minTime int, uniqueKey string, unique bool, lastChanged time.Time, proxyError string) (id int64, inserted bool, err error) {
+	now := time.Now()
+
+	result, err := pm.db.Exec(
+		`INSERT INTO proxies (type, proxy_str, api_key, unique_key, min_time, change_url, is_unique, last_changed, error, error_at, error_category, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		pType, proxyStr, apiKey, uniqueKey, minTime, changeUrl, unique, lastChanged.Unix(), proxyError, errorAtValue(proxyError, now), errorCategoryValue(proxyError), now, now,
+	)
+
+	if err == nil {
+		id, _ = result.LastInsertId()
+		pm.proxyCache[id] = &Proxy{
+			ID:          id,
+			Type:        pType,
+			ProxyStr:    proxyStr,
+			ApiKey:      apiKey,
+			ChangeUrl:   changeUrl,
+			MinTime:     minTime,
+			Running:     false,
+			Used:        0,
+			Unique:      unique,
+			LastChanged: lastChanged,
+			Error:       proxyError,
+			ErrorAt:     errorAtTime(proxyError, now),
+			Weight:      1,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		return id, true, nil
+	}
+
+	if !strings.Contains(err.Error(), "UNIQUE") {
+		return 0, false, err
+	}
+
+	pm.db.Exec(`UPDATE proxies SET proxy_str=?, min_time=?, change_url=?, is_unique=?, last_changed=?, error=?, error_at=?, error_category=?, updated_at=? WHERE unique_key=?`,
+		proxyStr, minTime, changeUrl, unique, lastChanged.Unix(), proxyError, errorAtValue(proxyError, now), errorCategoryValue(proxyError), now, uniqueKey)
+
+	pm.db.QueryRow(`SELECT id FROM proxies WHERE unique_key=?`, uniqueKey).Scan(&id)
+
+	// Update hoặc tạo mới cache entry
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.ProxyStr = proxyStr
 		cached.MinTime = minTime
 		cached.ChangeUrl = changeUrl
 		cached.Unique = unique
 		cached.LastChanged = lastChanged
 		cached.Error = proxyError
+		cached.ErrorAt = errorAtTime(proxyError, now)
 		cached.UpdatedAt = now
 	} else {
 		// Tạo mới cache entry nếu chưa có
@@ -447,28 +1013,131 @@ func (pm *ProxyManager) upsertProxy(pType ProxyType, proxyStr, apiKey, changeUrl
 			Unique:      unique,
 			LastChanged: lastChanged,
 			Error:       proxyError,
+			ErrorAt:     errorAtTime(proxyError, now),
+			Weight:      1,
 			CreatedAt:   now,
 			UpdatedAt:   now,
 		}
 	}
 
-	return id, nil
+	return id, false, nil
+}
+
+// errorAtValue giá trị cột error_at tương ứng với error (NULL nếu không lỗi)
+func errorAtValue(errMsg string, now time.Time) interface{} {
+	if errMsg == "" {
+		return nil
+	}
+	return now.Unix()
+}
+
+// errorAtTime giống errorAtValue nhưng cho cache
+func errorAtTime(errMsg string, now time.Time) time.Time {
+	if errMsg == "" {
+		return time.Time{}
+	}
+	return now
 }
 
 func (pm *ProxyManager) GetAvailableProxy(threadId int) (id int64, proxyStr string, err error) {
+	// PrefetchPerThread: ưu tiên proxy đã lấy sẵn cho thread
+	if id, proxyStr, ok := pm.takeStandby(threadId); ok {
+		return id, proxyStr, nil
+	}
+	return pm.acquireWithWait(threadId, "")
+}
+
+// acquireWithWait lấy proxy từ pool (chỉ proxy có tag nếu tag != ""),
+// thử lại trong AcquireWait nếu tạm thời chưa có proxy rảnh
+// NonBlockingChangeWait: proxy vừa đổi IP được trả về pool và lấy ngay proxy khác, tối đa bằng số proxy trong pool
+// (và không quá AcquireWait nếu > 0) để 1 lần lấy không rotate lần lượt cả pool khi change_url chậm hơn ChangeProxyWaitTime
+func (pm *ProxyManager) acquireWithWait(threadId int, tag string) (id int64, proxyStr string, err error) {
+	deadline := time.Now().Add(pm.acquireWait)
+	pm.mu.RLock()
+	maxWarming := len(pm.proxyCache)
+	pm.mu.RUnlock()
+	warming := 0
+	for {
+		id, proxyStr, err = pm.acquireProxy(threadId, tag, 0)
+		if errors.Is(err, errProxyWarming) {
+			warming++
+			if warming < maxWarming && (pm.acquireWait <= 0 || time.Now().Before(deadline)) {
+				// Proxy vừa đổi IP đã trả về pool, lấy ngay proxy khác
+				continue
+			}
+			err = fmt.Errorf("%w: %v", ErrNoAvailableProxy, err)
+		}
+		if !errors.Is(err, ErrNoAvailableProxy) || time.Now().Add(acquirePollInterval).After(deadline) {
+			return id, proxyStr, err
+		}
+		time.Sleep(acquirePollInterval)
+	}
+}
+
+// acquireProxy lấy proxy từ pool và ghi lịch sử sử dụng (nếu bật TrackUsage)
+// onlyID != 0: chỉ lấy đúng proxy đó (AcquireSpecific)
+func (pm *ProxyManager) acquireProxy(threadId int, tag string, onlyID int64) (id int64, proxyStr string, err error) {
+	// Proxy đã hết hạn: thử rotate trước, rotate thất bại thì đánh dấu lỗi
+	// (proxy hết hạn không bao giờ được chọn nên chỉ cần quét định kỳ, không cần mỗi lần lấy)
+	pm.maybeEvictExpired()
+
+	id, proxyStr, err = pm.getAvailableProxy(threadId, tag, onlyID)
+	if err == nil {
+		// IsBlockAssets: khởi động instance nếu chưa chạy (MaxInstances/InstanceIdleTTL)
+		// Không khởi động được (vd: port bị chiếm, đủ MaxInstances): trả proxy về pool, không trả về upstream thật
+		if ierr := pm.ensureInstance(id); ierr != nil {
+			pm.logf("[DumbProxy] Proxy %d: failed to start instance: %v\n", id, ierr)
+			pm.releaseProxy(id)
+			return 0, "", fmt.Errorf("%w: %v", ErrNoAvailableProxy, ierr)
+		}
+	}
+	if err == nil {
+		pm.mu.RLock()
+		if p, ok := pm.proxyCache[id]; ok {
+			pm.metrics.acquire(p.Type)
+		}
+		pm.mu.RUnlock()
+	}
+	if err == nil {
+		// ProactiveRotation: chuẩn bị sẵn IP tiếp theo trong lúc proxy đang được dùng
+		pm.maybeStageRotation(id)
+	}
+	if err == nil && pm.trackUsage {
+		pm.mu.Lock()
+		pm.db.Exec(`INSERT INTO proxy_usage (proxy_id, thread_id, acquired_at) VALUES (?, ?, ?)`, id, threadId, time.Now().Unix())
+		pm.mu.Unlock()
+	}
+	return id, proxyStr, err
+}
+
+func (pm *ProxyManager) getAvailableProxy(threadId int, tag string, onlyID int64) (id int64, proxyStr string, err error) {
 	pm.mu.Lock() // Dùng Lock thay vì RLock để tránh race condition
 	now := time.Now()
 	nowUnix := now.Unix()
 
+	// ErrorCooldown: proxy đã lỗi đủ lâu quay lại pool
+	if pm.errorCooldown > 0 {
+		pm.autoRecoverLocked(now)
+	}
+	// LeaseTTL: proxy bị giữ quá lâu (caller không ReleaseProxy) quay lại pool
+	if pm.leaseTTL > 0 {
+		pm.reclaimStaleLeasesLocked(now)
+	}
+
 	// Điều kiện theo từng loại proxy:
-	// - sticky non-unique (is_unique=0): không check gì
+	// - sticky non-unique (is_unique=0): không check gì (NonUniqueMaxUsed chỉ giới hạn số lần dùng chung session)
 	// - static: running=0 AND used < maxUsed (KHÔNG có refresh)
 	// - mobilehop: running=0 (luôn change_url khi lấy, không check used/min_time)
 	// - auto: running=0 (chỉ cấm sử dụng đồng thời, không giới hạn count)
 	// - ipv4xoay: running=0 AND (used < maxUsed OR đủ min_time) - giống tmproxy/kiotproxy
 	// - tmproxy/kiotproxy/sticky(unique): running=0 AND (used < maxUsed OR đủ min_time)
+	// RotationJitter: jitter không tính được trong SQL nên lấy hết ứng viên và lọc thêm bằng jitterDelayed
+	limit := 1
+	if pm.rotationJitter > 0 {
+		limit = -1
+	}
 	rows, err := pm.db.Query(`
-		SELECT id, type, proxy_str, api_key, change_url, min_time, running, used, is_unique, last_ip, last_changed, error, created_at, updated_at
+		SELECT id, type, proxy_str, api_key, change_url, min_time, running, used, is_unique, last_ip, last_changed, error, latency_ms, next_change_at, fresh_session, id_location, id_isp, COALESCE(nhamang, ''), COALESCE(tinhthanh, ''), socks5, ready_at, change_request, ip_expires_at, created_at, updated_at
 		FROM proxies
 		WHERE (
 			-- sticky non-unique: không check gì
@@ -483,67 +1152,147 @@ func (pm *ProxyManager) GetAvailableProxy(threadId int) (id int64, proxyStr stri
 			-- auto: chỉ check running=0
 			(type = 'auto' AND running=0)
 			OR
+			-- sticky(unique) fresh_session: chỉ check running=0 (mỗi lần lấy là session mới)
+			(type = 'sticky' AND is_unique = 1 AND fresh_session = 1 AND running=0)
+			OR
 			-- tmproxy/kiotproxy/ipv4xoay/sticky(unique): logic đầy đủ
 			(type NOT IN ('static', 'mobilehop', 'auto') AND is_unique = 1 AND running=0 AND (
 				used < ?
 				OR
-				(min_time = 0 OR (last_changed IS NULL OR (? - last_changed >= min_time)))
+				((min_time = 0 OR (last_changed IS NULL OR (? - last_changed >= min_time))
+					-- IP sắp hết hạn (ip_expires_at): đổi IP không cần đợi min_time
+					OR (ip_expires_at > 0 AND ip_expires_at <= ?))
+					AND (next_change_at IS NULL OR next_change_at <= ?))
 			))
 		)
+		-- bỏ qua proxy có api key đã hết hạn (EvictExpired sẽ rotate hoặc đánh dấu lỗi)
+		AND (expires_at IS NULL OR expires_at = 0 OR expires_at > ?)
+		-- bỏ qua proxy đang drain (DrainProxy)
+		AND (draining IS NULL OR draining = 0)
+		-- bỏ qua proxy vừa đổi IP chưa hết ChangeProxyWaitTime (NonBlockingChangeWait)
+		AND (ready_at IS NULL OR ready_at <= ?)
+		-- GetAvailableProxyByTag: chỉ proxy có tag
+		AND (? = '' OR instr(COALESCE(tags, ''), ?) > 0)
+		-- ErrorCooldown: bỏ qua proxy đang lỗi (chưa hết cooldown)
+		AND (? = 0 OR error IS NULL OR error = '')
+		-- HealthThreshold: bỏ qua proxy đang bị hạ cấp
+		AND (demoted_until IS NULL OR demoted_until <= ?)
+		-- AcquireSpecific: chỉ proxy được chỉ định
+		AND (? = 0 OR id = ?)
 		ORDER BY
 			CASE WHEN is_unique = 0 THEN 0 ELSE 1 END,
-			used ASC,
-			id ASC
-		LIMIT 1
-	`, pm.maxUsed, pm.maxUsed, nowUnix)
+			`+pm.selectionOrder()+`
+		LIMIT ?
+	`, pm.maxUsed, pm.maxUsed, nowUnix, now.Add(ipExpiryMargin).Unix(), nowUnix, nowUnix, nowUnix, tag, ","+tag+",", pm.errorCooldown > 0, nowUnix, onlyID, onlyID, limit)
 
 	if err != nil {
 		pm.mu.Unlock()
 		return 0, "", err
 	}
 
-	if !rows.Next() {
-		rows.Close()
-		pm.mu.Unlock()
-		return 0, "", fmt.Errorf("no available proxy")
-	}
-
 	var p Proxy
-	var lastIP sql.NullString
-	var lastChangedUnix sql.NullInt64
-	var errStr sql.NullString
-	var apiKey sql.NullString
-	var changeUrl sql.NullString
-	err = rows.Scan(&p.ID, &p.Type, &p.ProxyStr, &apiKey, &changeUrl, &p.MinTime, &p.Running, &p.Used, &p.Unique, &lastIP, &lastChangedUnix, &errStr, &p.CreatedAt, &p.UpdatedAt)
-	rows.Close()
+	found := false
+	for rows.Next() {
+		var lastIP sql.NullString
+		var lastChangedUnix sql.NullInt64
+		var errStr sql.NullString
+		var apiKey sql.NullString
+		var changeUrl sql.NullString
+		var latencyMs sql.NullInt64
+		var nextChangeAt sql.NullInt64
+		var readyAt sql.NullInt64
+		var changeRequest sql.NullString
+		var ipExpiresAt sql.NullInt64
+		p = Proxy{}
+		err = rows.Scan(&p.ID, &p.Type, &p.ProxyStr, &apiKey, &changeUrl, &p.MinTime, &p.Running, &p.Used, &p.Unique, &lastIP, &lastChangedUnix, &errStr, &latencyMs, &nextChangeAt, &p.FreshSessionEachUse, &p.IDLocation, &p.IDISP, &p.NhaMang, &p.TinhThanh, &p.SOCKS5, &readyAt, &changeRequest, &ipExpiresAt, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			pm.mu.Unlock()
+			return 0, "", err
+		}
 
-	if err != nil {
+		if apiKey.Valid {
+			p.ApiKey = apiKey.String
+		}
+		if changeUrl.Valid {
+			p.ChangeUrl = changeUrl.String
+		}
+		if lastIP.Valid {
+			p.LastIP = lastIP.String
+		}
+		if lastChangedUnix.Valid {
+			p.LastChanged = time.Unix(lastChangedUnix.Int64, 0)
+		}
+		if errStr.Valid {
+			p.Error = errStr.String
+		}
+		if latencyMs.Valid {
+			p.Latency = time.Duration(latencyMs.Int64) * time.Millisecond
+		}
+		if nextChangeAt.Valid && nextChangeAt.Int64 > 0 {
+			p.NextChangeAt = time.Unix(nextChangeAt.Int64, 0)
+		}
+		if readyAt.Valid && readyAt.Int64 > 0 {
+			p.ReadyAt = time.Unix(readyAt.Int64, 0)
+		}
+		if ipExpiresAt.Valid && ipExpiresAt.Int64 > 0 {
+			p.IPExpiresAt = time.Unix(ipExpiresAt.Int64, 0)
+		}
+		p.ChangeRequest = parseChangeRequest(changeRequest.String)
+
+		// RotationJitter: SQL chỉ so với min_time gốc, proxy đã hết MaxUsed nhưng chưa qua min_time + jitter thì bỏ qua
+		if pm.jitterDelayed(&p, now) {
+			continue
+		}
+		found = true
+		break
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
 		pm.mu.Unlock()
 		return 0, "", err
 	}
+	rows.Close()
 
-	if apiKey.Valid {
-		p.ApiKey = apiKey.String
-	}
-	if changeUrl.Valid {
-		p.ChangeUrl = changeUrl.String
-	}
-	if lastIP.Valid {
-		p.LastIP = lastIP.String
-	}
-	if lastChangedUnix.Valid {
-		p.LastChanged = time.Unix(lastChangedUnix.Int64, 0)
-	}
-	if errStr.Valid {
-		p.Error = errStr.String
+	if !found {
+		down := pm.downProvidersLocked()
+		pm.mu.Unlock()
+		if len(down) > 0 {
+			return 0, "", &ProviderDownError{Providers: down}
+		}
+		return 0, "", ErrNoAvailableProxy
 	}
 
 	// Proxy không unique: không cần set running/used, chỉ cần xử lý proxyStr và trả về
 	if !p.Unique {
+		// Sticky với NonUniqueMaxUsed > 0: dùng lại session hiện tại cho tới khi đủ N lần
+		// Bật StickySessionPerThread thì session cố định theo thread, bỏ qua NonUniqueMaxUsed
+		if p.Type == ProxyTypeSticky && pm.nonUniqueMaxUsed > 0 && !pm.stickySessionPerThread {
+			session, ok := pm.stickySessions[p.ID]
+			if !ok || p.Used >= pm.nonUniqueMaxUsed {
+				// Hết lượt (hoặc chưa có session): tạo session mới, reset used=1
+				session = pm.expandStickyProxyStr(p.ID, threadId, p.ProxyStr)
+				pm.stickySessions[p.ID] = session
+				pm.db.Exec(`UPDATE proxies SET used=1, last_changed=?, updated_at=? WHERE id=?`, nowUnix, now, p.ID)
+				if cached, ok := pm.proxyCache[p.ID]; ok {
+					cached.Used = 1
+					cached.LastChanged = now
+					cached.UpdatedAt = now
+				}
+			} else {
+				pm.db.Exec(`UPDATE proxies SET used=used+1, updated_at=? WHERE id=?`, now, p.ID)
+				if cached, ok := pm.proxyCache[p.ID]; ok {
+					cached.Used = cached.Used + 1
+					cached.UpdatedAt = now
+				}
+			}
+			pm.mu.Unlock()
+			return p.ID, pm.getConnectionString(p.ID, session), nil
+		}
 		pm.mu.Unlock()
 		// Sticky: xử lý proxyStr để thay thế ${random}
 		if p.Type == ProxyTypeSticky {
-			processedProxyStr := processStickyProxyStr(p.ProxyStr)
+			processedProxyStr := pm.expandStickyProxyStr(p.ID, threadId, p.ProxyStr)
 			return p.ID, pm.getConnectionString(p.ID, processedProxyStr), nil
 		}
 		// Các loại khác: trả về proxyStr hoặc localhost:port
@@ -551,25 +1300,47 @@ func (pm *ProxyManager) GetAvailableProxy(threadId int) (id int64, proxyStr stri
 	}
 
 	// Acquire proxy: set running=true và thread_id trước (chưa tăng used)
-	// Đã giữ Lock từ đầu hàm, không cần Lock lại
-	if _, err := pm.db.Exec(`UPDATE proxies SET running=true, thread_id=?, updated_at=? WHERE id=?`, threadId, now, p.ID); err != nil {
+	// Đã giữ Lock từ đầu hàm (select và acquire là 1 thao tác trong process)
+	// Điều kiện running=0 bảo vệ thêm khi nhiều process dùng chung file db
+	result, err := pm.db.Exec(`UPDATE proxies SET running=true, thread_id=?, running_since=?, ready_at=NULL, updated_at=? WHERE id=? AND running=0`, threadId, nowUnix, now, p.ID)
+	if err != nil {
 		pm.mu.Unlock()
 		return 0, "", fmt.Errorf("failed to acquire proxy: %v", err)
 	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		pm.mu.Unlock()
+		return 0, "", ErrNoAvailableProxy
+	}
 	if cached, ok := pm.proxyCache[p.ID]; ok {
 		cached.Running = true
+		cached.RunningSince = time.Unix(nowUnix, 0)
+		cached.ReadyAt = time.Time{}
 		cached.UpdatedAt = now
 	}
 	pm.mu.Unlock() // Unlock sau khi đã set running=true
 
 	// Kiểm tra điều kiện restart: last_changed + min_time <= time hiện tại
-	timeSinceLastChange := now.Sub(p.LastChanged).Seconds()
-	canChangeIP := p.MinTime == 0 || timeSinceLastChange >= float64(p.MinTime)
+	// và đã qua cooldown do provider trả về (nextRequestAt/next_request), tức max(min_time, provider_cooldown)
+	// IP sắp hết hạn (kiotproxy: ttl) thì không cần đợi min_time
+	canChangeIP := pm.minTimeElapsed(&p, now) && !now.Before(p.NextChangeAt)
+
+	// Proxy vừa đổi IP và chờ xong ChangeProxyWaitTime (NonBlockingChangeWait) nhưng chưa được cấp phát lần nào:
+	// dùng luôn IP đó, không đổi IP lần nữa
+	warmed := !p.ReadyAt.IsZero()
+	canChangeIP = canChangeIP && !warmed
+
+	// MaxRotationsPerHour: api key đã đổi IP đủ số lần cho phép → dùng tiếp IP hiện tại
+	if canChangeIP && pm.rotationLimited(&p, now) {
+		pm.logf("[ProxyManager] Proxy %d: %v (%d per hour), keeping current IP\n", p.ID, ErrRotationLimit, pm.maxRotationsPerHour)
+		canChangeIP = false
+	}
 
 	// Sticky với unique=true: thay ${random} = restart (change IP)
+	// FreshSessionEachUse: luôn restart (session mới mỗi lần lấy)
 	if p.Type == ProxyTypeSticky && p.Unique {
-		if canChangeIP {
+		if canChangeIP || p.FreshSessionEachUse {
 			// Đủ điều kiện restart: reset used=1, update last_changed
+			pm.metrics.rotation(p.Type)
 			pm.mu.Lock()
 			pm.db.Exec(`UPDATE proxies SET last_changed=?, used=1, error='', updated_at=? WHERE id=?`, now.Unix(), now, p.ID)
 			if cached, ok := pm.proxyCache[p.ID]; ok {
@@ -591,44 +1362,72 @@ func (pm *ProxyManager) GetAvailableProxy(threadId int) (id int64, proxyStr stri
 		}
 
 		// Xử lý proxyStr để thay thế ${random}
-		processedProxyStr := processStickyProxyStr(p.ProxyStr)
+		processedProxyStr := pm.expandStickyProxyStr(p.ID, threadId, p.ProxyStr)
+		if p.FreshSessionEachUse {
+			// Không dùng session cố định theo thread (StickySessionPerThread)
+			processedProxyStr = processStickyProxyStrWith(p.ProxyStr, pm.stickyTokenLen, pm.stickyTokenAlphabet)
+		}
 		return p.ID, pm.getConnectionString(p.ID, processedProxyStr), nil
 	}
 
-	// TMProxy: restart nếu đủ điều kiện
-	if p.Type == ProxyTypeTMProxy && canChangeIP && p.ApiKey != "" {
-		// TMProxy: gọi GetNewProxy
-		resp, err := service.GetTMProxy().GetNewProxy(p.ApiKey, 0, 0)
-		if err != nil {
-			// GetNewProxy thất bại - đánh dấu error, set running=0, clear thread_id
-			errMsg := fmt.Sprintf("GetNewProxy failed: %v", err)
+	// ProactiveRotation: chuyển sang IP đã chuẩn bị sẵn, không cần gọi GetNewProxy
+	if isProviderType(p.Type) && canChangeIP {
+		if newProxyStr, meta, ok := pm.takeStagedRotation(p.ID); ok {
 			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET error=?, running=0, thread_id=NULL, updated_at=? WHERE id=?`, errMsg, now, p.ID)
+			pm.db.Exec(`UPDATE proxies SET proxy_str=?, last_changed=?, used=1, error='', updated_at=? WHERE id=?`, newProxyStr, now.Unix(), now, p.ID)
 			if cached, ok := pm.proxyCache[p.ID]; ok {
-				cached.Error = errMsg
-				cached.Running = false
+				cached.ProxyStr = newProxyStr
+				cached.LastChanged = now
+				cached.Used = 1
+				cached.Error = ""
 				cached.UpdatedAt = now
 			}
+			pm.saveProxyMeta(p.ID, meta)
 			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("%s", errMsg)
+
+			// Restart dumbproxy instance với upstream mới (nếu IsBlockAssets=true)
+			pm.restartDumbProxyInstance(p.ID, newProxyStr)
+			pm.metrics.rotation(p.Type)
+
+			// IP đã được chuẩn bị từ trước nên không cần đợi ChangeProxyWaitTime
+			return p.ID, pm.getConnectionString(p.ID, newProxyStr), nil
 		}
+	}
 
-		if resp.Code != 0 {
-			// API trả về error code - đánh dấu error, set running=0, clear thread_id
-			errMsg := fmt.Sprintf("tmproxy api returned code: %d, message: %s", resp.Code, resp.Message)
+	// Provider (tmproxy/kiotproxy/ipv4xoay/...): lấy IP mới nếu đủ điều kiện
+	if isProviderType(p.Type) && canChangeIP && p.ApiKey != "" {
+		newProxyStr, meta, err := pm.fetchNewProxy(pm.baseContext(), &p)
+		if errors.Is(err, ErrProviderBlocking) {
+			// Provider tạm thời chặn (vd: ipv4xoay status 101): không set error, set running=0, clear thread_id, retry sau
+			pm.mu.Lock()
+			pm.db.Exec(`UPDATE proxies SET running=0, thread_id=NULL, running_since=NULL, updated_at=? WHERE id=?`, now, p.ID)
+			if cached, ok := pm.proxyCache[p.ID]; ok {
+				cached.Running = false
+				cached.UpdatedAt = now
+			}
+			pm.mu.Unlock()
+			pm.logf("[ProxyManager] Proxy %d: %v\n", p.ID, err)
+			return 0, "", err
+		}
+		if err != nil {
+			// GetNew thất bại - đánh dấu error, set running=0, clear thread_id
+			errMsg := err.Error()
+			pm.logf("[ProxyManager] Proxy %d: %s\n", p.ID, errMsg)
 			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET error=?, running=0, thread_id=NULL, updated_at=? WHERE id=?`, errMsg, now, p.ID)
+			pm.db.Exec(`UPDATE proxies SET error=?, error_at=?, error_category=?, running=0, thread_id=NULL, running_since=NULL, updated_at=? WHERE id=?`, errMsg, now.Unix(), errorCategoryValue(errMsg), now, p.ID)
 			if cached, ok := pm.proxyCache[p.ID]; ok {
 				cached.Error = errMsg
+				cached.ErrorAt = now
 				cached.Running = false
 				cached.UpdatedAt = now
 			}
+			pm.recordHealthLocked(p.ID, false, now)
 			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("%s", errMsg)
+			return 0, "", err
 		}
 
-		// GetNewProxy thành công - update proxy mới, reset used=1, giữ running=true, clear error
-		newProxyStr := fmt.Sprintf("%s:%s:%s", resp.Data.HTTPS, resp.Data.Username, resp.Data.Password)
+		// GetNew thành công - update proxy mới, reset used=1, giữ running=true, clear error
+		pm.updateProxyMeta(p.ID, meta)
 
 		pm.mu.Lock()
 		pm.db.Exec(`UPDATE proxies SET proxy_str=?, last_changed=?, used=1, error='', updated_at=? WHERE id=?`, newProxyStr, now.Unix(), now, p.ID)
@@ -649,194 +1448,708 @@ func (pm *ProxyManager) GetAvailableProxy(threadId int) (id int64, proxyStr stri
 		// Restart dumbproxy instance với upstream mới (nếu IsBlockAssets=true)
 		pm.restartDumbProxyInstance(p.ID, newProxyStr)
 
-		// Đợi ChangeProxyWaitTime trước khi trả result
-		if pm.changeProxyWaitTime > 0 {
-			time.Sleep(pm.changeProxyWaitTime)
+		pm.metrics.rotation(p.Type)
+
+		// Đợi ChangeProxyWaitTime trước khi trả result (NonBlockingChangeWait: trả proxy về pool, lấy proxy khác)
+		if !pm.waitAfterChange(p.ID) {
+			return 0, "", errProxyWarming
+		}
+
+		return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+	}
+
+	// MobileHop: luôn change_url khi lấy proxy (không check canChangeIP)
+	if p.Type == ProxyTypeMobileHop && p.ChangeUrl != "" && !warmed {
+		// Gọi callChangeURL
+		if err := pm.callChangeURL(pm.baseContext(), p.ChangeUrl, pm.changeRequestFor(&p)); err != nil {
+			// callChangeURL thất bại - đánh dấu error, set running=false, clear thread_id
+			// (modem có thể đã mất kết nối, không cấp phát lại tới khi hết ErrorCooldown/ClearProxyError)
+			errMsg := fmt.Sprintf("callChangeURL failed: %v", err)
+			pm.logf("[ProxyManager] Proxy %d: %s\n", p.ID, errMsg)
+			pm.metrics.apiFailure(p.Type)
+			pm.mu.Lock()
+			pm.db.Exec(`UPDATE proxies SET error=?, error_at=?, error_category=?, running=false, thread_id=NULL, running_since=NULL, updated_at=? WHERE id=?`, errMsg, now.Unix(), errorCategoryValue(errMsg), now, p.ID)
+			if cached, ok := pm.proxyCache[p.ID]; ok {
+				cached.Error = errMsg
+				cached.ErrorAt = now
+				cached.Running = false
+				cached.UpdatedAt = now
+			}
+			pm.recordHealthLocked(p.ID, false, now)
+			pm.mu.Unlock()
+
+			// IsBlockAssets: dừng instance để cổng local không tiếp tục phục vụ qua upstream có thể đã chết,
+			// instance được khởi động lại khi đổi IP thành công
+			if pm.isBlockAssets {
+				GetDumbProxyManager().StopInstance(p.ID)
+			}
+			return 0, "", fmt.Errorf("%s", errMsg)
+		}
+
+		// callChangeURL thành công - update last_changed, reset used=1, giữ running=true, clear error
+		pm.mu.Lock()
+		pm.db.Exec(`UPDATE proxies SET last_changed=?, used=1, error='', updated_at=? WHERE id=?`, now.Unix(), now, p.ID)
+		if cached, ok := pm.proxyCache[p.ID]; ok {
+			cached.LastChanged = now
+			cached.Used = 1
+			cached.Error = ""
+			cached.UpdatedAt = now
+		}
+		pm.mu.Unlock()
+
+		p.LastChanged = now
+		p.Error = ""
+		p.UpdatedAt = now
+
+		// Instance bị dừng do lần đổi IP trước thất bại: khởi động lại
+		pm.resumeDumbProxyInstance(p.ID, p.ProxyStr)
+
+		pm.metrics.rotation(p.Type)
+
+		// Đợi ChangeProxyWaitTime trước khi trả result (NonBlockingChangeWait: trả proxy về pool, lấy proxy khác)
+		if !pm.waitAfterChange(p.ID) {
+			return 0, "", errProxyWarming
+		}
+
+		return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+	}
+
+	// Không đủ điều kiện restart: update used++ và trả về proxy hiện tại
+	// Auto không tăng used (không giới hạn count)
+	if p.Type != ProxyTypeAuto {
+		pm.mu.Lock()
+		pm.db.Exec(`UPDATE proxies SET used=used+1, updated_at=? WHERE id=?`, now, p.ID)
+		if cached, ok := pm.proxyCache[p.ID]; ok {
+			cached.Used = cached.Used + 1
+			cached.UpdatedAt = now
+		}
+		pm.mu.Unlock()
+	}
+
+	return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+}
+
+// errProxyWarming proxy vừa đổi IP đã được trả về pool để chờ ChangeProxyWaitTime (NonBlockingChangeWait),
+// GetAvailableProxy sẽ lấy ngay proxy khác
+var errProxyWarming = errors.New("proxy is warming up after changing IP")
+
+// waitAfterChange xử lý ChangeProxyWaitTime sau khi proxy vừa đổi IP trong getAvailableProxy
+// - mặc định: sleep rồi trả về true (caller tiếp tục dùng proxy)
+// - NonBlockingChangeWait: không sleep, trả proxy về pool với ready_at = now + ChangeProxyWaitTime, trả về false
+func (pm *ProxyManager) waitAfterChange(id int64) bool {
+	if pm.changeProxyWaitTime <= 0 {
+		return true
+	}
+	if !pm.nonBlockingChangeWait {
+		time.Sleep(pm.changeProxyWaitTime)
+		return true
+	}
+	pm.markWarming(id, true)
+	return false
+}
+
+// markWarming đánh dấu proxy chỉ được cấp phát lại sau ready_at = now + ChangeProxyWaitTime
+// release=true: trả proxy về pool (running=0, used=0 vì IP mới chưa được dùng lần nào)
+func (pm *ProxyManager) markWarming(id int64, release bool) {
+	now := time.Now()
+	readyAt := now.Add(pm.changeProxyWaitTime)
+	// Làm tròn lên giây để không cấp phát sớm hơn ChangeProxyWaitTime
+	readyAtUnix := readyAt.Unix()
+	if readyAt.Nanosecond() > 0 {
+		readyAtUnix++
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if release {
+		pm.db.Exec(`UPDATE proxies SET ready_at=?, running=0, thread_id=NULL, running_since=NULL, used=0, updated_at=? WHERE id=?`, readyAtUnix, now, id)
+	} else {
+		pm.db.Exec(`UPDATE proxies SET ready_at=?, updated_at=? WHERE id=?`, readyAtUnix, now, id)
+	}
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.ReadyAt = time.Unix(readyAtUnix, 0)
+		if release {
+			cached.Running = false
+			cached.Used = 0
+		}
+		cached.UpdatedAt = now
+	}
+}
+
+// selectionOrder trả về mệnh đề ORDER BY (sau khi đã ưu tiên proxy non-unique) theo SelectionStrategy
+func (pm *ProxyManager) selectionOrder() string {
+	switch pm.strategy {
+	case StrategyFastestFirst:
+		// Proxy chưa đo latency (latency_ms=0) xếp sau proxy đã đo
+		return `CASE WHEN latency_ms IS NULL OR latency_ms <= 0 THEN 1 ELSE 0 END,
+			latency_ms ASC,
+			used ASC,
+			id ASC`
+	case StrategyWeightedRandom:
+		// Mỗi proxy nhận key = -ln(u)/weight (u ngẫu nhiên trong (0, 1]), proxy có key nhỏ nhất được chọn
+		// với xác suất weight / tổng weight của các proxy đủ điều kiện
+		return `-ln((abs(random() % 1000000) + 1) / 1000000.0) / (CASE WHEN weight > 0 THEN weight ELSE 1 END) ASC,
+			id ASC`
+	default:
+		return `used ASC,
+			id ASC`
+	}
+}
+
+// latencyEWMAWeight trọng số của mẫu mới khi cập nhật latency trung bình
+const latencyEWMAWeight = 0.3
+
+// ReportResult ghi nhận latency đo được khi sử dụng proxy
+// Latency được lưu dạng trung bình động (EWMA) để giảm ảnh hưởng của các mẫu bất thường
+// Mỗi lần ReportResult cũng được tính là 1 lần thành công vào health score (xem ReportFailure)
+func (pm *ProxyManager) ReportResult(id int64, latency time.Duration) error {
+	if latency <= 0 {
+		return fmt.Errorf("invalid latency: %v", latency)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var current sql.NullInt64
+	if err := pm.db.QueryRow(`SELECT latency_ms FROM proxies WHERE id=?`, id).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("proxy %d not found", id)
+		}
+		return err
+	}
+
+	sampleMs := latency.Milliseconds()
+	if sampleMs == 0 {
+		sampleMs = 1
+	}
+	newMs := sampleMs
+	if current.Valid && current.Int64 > 0 {
+		newMs = int64(float64(current.Int64)*(1-latencyEWMAWeight) + float64(sampleMs)*latencyEWMAWeight)
+	}
+
+	now := time.Now()
+	if _, err := pm.db.Exec(`UPDATE proxies SET latency_ms=?, updated_at=? WHERE id=?`, newMs, now, id); err != nil {
+		return err
+	}
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.Latency = time.Duration(newMs) * time.Millisecond
+		cached.UpdatedAt = now
+	}
+	pm.recordHealthLocked(id, true, now)
+	return nil
+}
+
+// getProxyByID đọc thông tin proxy từ database theo id
+func (pm *ProxyManager) getProxyByID(id int64) (*Proxy, error) {
+	var p Proxy
+	var proxyStr sql.NullString
+	var apiKey sql.NullString
+	var changeUrl sql.NullString
+	var lastIP sql.NullString
+	var lastChangedUnix sql.NullInt64
+	var errStr sql.NullString
+	var latencyMs sql.NullInt64
+	var location sql.NullString
+	var isp sql.NullString
+	var expiresAt sql.NullInt64
+	var nextChangeAt sql.NullInt64
+	var changeRequest sql.NullString
+	var tags sql.NullString
+	var errorAt sql.NullInt64
+	var ipExpiresAt sql.NullInt64
+	var demotedUntil sql.NullInt64
+	var runningSince sql.NullInt64
+	var httpStr sql.NullString
+	var socks5Str sql.NullString
+	err := pm.db.QueryRow(`
+		SELECT id, type, proxy_str, api_key, change_url, min_time, running, used, is_unique, last_ip, last_changed, error, latency_ms, location, isp, expires_at, next_change_at, fresh_session, parallel_sessions, id_location, id_isp, COALESCE(nhamang, ''), COALESCE(tinhthanh, ''), socks5, change_request, tags, draining, COALESCE(weight, 1), error_at, ip_expires_at, demoted_until, running_since, http_str, socks5_str, created_at, updated_at
+		FROM proxies
+		WHERE id=?
+	`, id).Scan(&p.ID, &p.Type, &proxyStr, &apiKey, &changeUrl, &p.MinTime, &p.Running, &p.Used, &p.Unique, &lastIP, &lastChangedUnix, &errStr, &latencyMs, &location, &isp, &expiresAt, &nextChangeAt, &p.FreshSessionEachUse, &p.ParallelSessions, &p.IDLocation, &p.IDISP, &p.NhaMang, &p.TinhThanh, &p.SOCKS5, &changeRequest, &tags, &p.Draining, &p.Weight, &errorAt, &ipExpiresAt, &demotedUntil, &runningSince, &httpStr, &socks5Str, &p.CreatedAt, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("proxy %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyStr.Valid {
+		p.ProxyStr = proxyStr.String
+	}
+	if apiKey.Valid {
+		p.ApiKey = apiKey.String
+	}
+	if changeUrl.Valid {
+		p.ChangeUrl = changeUrl.String
+	}
+	if lastIP.Valid {
+		p.LastIP = lastIP.String
+	}
+	if lastChangedUnix.Valid {
+		p.LastChanged = time.Unix(lastChangedUnix.Int64, 0)
+	}
+	if errStr.Valid {
+		p.Error = errStr.String
+	}
+	if latencyMs.Valid {
+		p.Latency = time.Duration(latencyMs.Int64) * time.Millisecond
+	}
+	if location.Valid {
+		p.Location = location.String
+	}
+	if isp.Valid {
+		p.ISP = isp.String
+	}
+	if expiresAt.Valid && expiresAt.Int64 > 0 {
+		p.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+	if nextChangeAt.Valid && nextChangeAt.Int64 > 0 {
+		p.NextChangeAt = time.Unix(nextChangeAt.Int64, 0)
+	}
+	if errorAt.Valid && errorAt.Int64 > 0 {
+		p.ErrorAt = time.Unix(errorAt.Int64, 0)
+	}
+	if ipExpiresAt.Valid && ipExpiresAt.Int64 > 0 {
+		p.IPExpiresAt = time.Unix(ipExpiresAt.Int64, 0)
+	}
+	if demotedUntil.Valid && demotedUntil.Int64 > 0 {
+		p.DemotedUntil = time.Unix(demotedUntil.Int64, 0)
+	}
+	if runningSince.Valid && runningSince.Int64 > 0 {
+		p.RunningSince = time.Unix(runningSince.Int64, 0)
+	}
+	p.HTTPStr = httpStr.String
+	p.SOCKS5Str = socks5Str.String
+	p.ChangeRequest = parseChangeRequest(changeRequest.String)
+	p.Tags = decodeTags(tags.String)
+	return &p, nil
+}
+
+// ForceChange ép đổi IP cho proxy ngay lập tức, bỏ qua điều kiện min_time
+// - tmproxy/kiotproxy/ipv4xoay: gọi GetNewProxy
+// - mobilehop: gọi change_url
+// - static/sticky/auto: không hỗ trợ đổi IP, trả về lỗi
+// Sau khi đổi thành công: cập nhật proxy_str, last_changed và reset used=0 (không thay đổi running)
+func (pm *ProxyManager) ForceChange(id int64) (newProxyStr string, err error) {
+	return pm.ForceChangeContext(context.Background(), id)
+}
+
+// ForceChangeContext giống ForceChange, lần gọi provider/change_url (kể cả các lần retry) dừng khi ctx bị huỷ
+// hoặc ProxyManager bị Close
+func (pm *ProxyManager) ForceChangeContext(ctx context.Context, id int64) (newProxyStr string, err error) {
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := pm.withManagerContext(ctx)
+	defer cancel()
+	newProxyStr, err = pm.changeProxyIP(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	// Đợi ChangeProxyWaitTime trước khi trả result
+	// NonBlockingChangeWait: không đợi, proxy chỉ được cấp phát lại sau ready_at
+	if pm.nonBlockingChangeWait && pm.changeProxyWaitTime > 0 {
+		pm.markWarming(id, false)
+	} else if pm.changeProxyWaitTime > 0 {
+		time.Sleep(pm.changeProxyWaitTime)
+	}
+
+	return newProxyStr, nil
+}
+
+// changeProxyIP đổi IP cho proxy (không check min_time, không đợi ChangeProxyWaitTime)
+// Cập nhật proxy_str, last_changed, reset used=0 và restart dumbproxy instance nếu cần
+func (pm *ProxyManager) changeProxyIP(ctx context.Context, p *Proxy) (newProxyStr string, err error) {
+	id := p.ID
+	newProxyStr = p.ProxyStr
+	var meta providerMeta
+	switch {
+	case isProviderType(p.Type):
+		if pm.rotationLimited(p, time.Now()) {
+			return "", fmt.Errorf("proxy %d: %w (%d per hour)", id, ErrRotationLimit, pm.maxRotationsPerHour)
+		}
+		newProxyStr, meta, err = pm.fetchNewProxy(ctx, p)
+		if err != nil {
+			return "", err
+		}
+
+	case p.Type == ProxyTypeMobileHop:
+		if err := pm.callChangeURL(ctx, p.ChangeUrl, pm.changeRequestFor(p)); err != nil {
+			pm.metrics.apiFailure(p.Type)
+			return "", fmt.Errorf("callChangeURL failed: %v", err)
+		}
+
+	default:
+		return "", fmt.Errorf("proxy type %s does not support changing IP", p.Type)
+	}
+
+	now := time.Now()
+	pm.mu.Lock()
+	pm.db.Exec(`UPDATE proxies SET proxy_str=?, last_changed=?, used=0, error='', updated_at=? WHERE id=?`, newProxyStr, now.Unix(), now, id)
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.ProxyStr = newProxyStr
+		cached.LastChanged = now
+		cached.Used = 0
+		cached.Error = ""
+		cached.UpdatedAt = now
+	}
+	pm.mu.Unlock()
+
+	if !meta.isZero() {
+		pm.updateProxyMeta(id, meta)
+	}
+	pm.metrics.rotation(p.Type)
+
+	// Restart dumbproxy instance với upstream mới (nếu IsBlockAssets=true)
+	// mobilehop giữ nguyên upstream nhưng instance có thể đã bị dừng do lần đổi IP trước thất bại
+	if newProxyStr != p.ProxyStr {
+		pm.restartDumbProxyInstance(id, newProxyStr)
+	} else if p.Type == ProxyTypeMobileHop {
+		pm.resumeDumbProxyInstance(id, newProxyStr)
+	}
+
+	return newProxyStr, nil
+}
+
+// fetchNewProxy gọi GetNew của provider (tmproxy/kiotproxy/ipv4xoay/...), không cập nhật db
+func (pm *ProxyManager) fetchNewProxy(ctx context.Context, p *Proxy) (newProxyStr string, meta providerMeta, err error) {
+	if p.ApiKey == "" {
+		return "", meta, fmt.Errorf("proxy %d has no api key", p.ID)
+	}
+	provider, ok := getProvider(p.Type)
+	if !ok {
+		return "", meta, fmt.Errorf("proxy type %s does not support changing IP", p.Type)
+	}
+	res, err := provider.GetNew(ctx, p.ApiKey, providerOptionsFor(p))
+	if err != nil {
+		pm.metrics.apiFailure(p.Type)
+		return "", meta, err
+	}
+	pm.recordRotation(p, time.Now())
+	newProxyStr, err = res.connectionString(p.SOCKS5)
+	if err != nil {
+		return "", meta, err
+	}
+	return newProxyStr, res.meta(), nil
+}
+
+// RotateAllEligible đổi IP cho tất cả proxy đủ điều kiện
+// Điều kiện: loại proxy hỗ trợ đổi IP (tmproxy/kiotproxy/ipv4xoay/mobilehop), không bị lỗi,
+// không đang được sử dụng (running=0) và đã đủ min_time kể từ lần đổi trước
+// Trả về số proxy đổi IP thành công, lỗi (nếu có) được gộp lại
+func (pm *ProxyManager) RotateAllEligible() (int, error) {
+	ids, err := pm.eligibleRotationIDs(append(providerTypes(), ProxyTypeMobileHop)...)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	var result error
+	for _, id := range ids {
+		ok, err := pm.rotateIfIdle(id)
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+		if ok {
+			rotated++
+		}
+	}
+
+	return rotated, result
+}
+
+// rotateIfIdle đổi IP cho 1 proxy của RotateAllEligible, trả về true nếu đổi thành công
+// Proxy được claimProxy trong lúc đổi IP để thread khác không lấy được proxy string sắp bị thay
+func (pm *ProxyManager) rotateIfIdle(id int64) (bool, error) {
+	// Proxy có thể đã được lấy trong lúc đang rotate các proxy khác
+	if !pm.claimProxy(id) {
+		return false, nil
+	}
+	defer pm.unclaimProxy(id)
+
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	// Api key đã đổi IP đủ MaxRotationsPerHour lần: bỏ qua, không tính là lỗi
+	if pm.rotationLimited(p, time.Now()) {
+		return false, nil
+	}
+	if _, err := pm.changeProxyIP(pm.baseContext(), p); err != nil {
+		return false, fmt.Errorf("proxy %d: %w", id, err)
+	}
+	return true, nil
+}
+
+// EvictExpired xử lý các proxy có api key đã hết hạn (expires_at do provider trả về đã qua)
+// - tmproxy/kiotproxy/ipv4xoay: thử lấy proxy mới, nếu expiration mới vẫn đã qua hoặc lấy thất bại thì đánh dấu error
+// - các loại khác: đánh dấu error
+// Chỉ xử lý proxy không bị lỗi và không đang được sử dụng (proxy đang chạy sẽ được xử lý sau khi release)
+// Trả về số proxy bị đánh dấu lỗi
+func (pm *ProxyManager) EvictExpired() (int, error) {
+	pm.mu.RLock()
+	rows, err := pm.db.Query(`
+		SELECT id
+		FROM proxies
+		WHERE expires_at IS NOT NULL AND expires_at > 0 AND expires_at <= ?
+			AND running=0
+			AND (error IS NULL OR error = '')
+		ORDER BY id ASC
+	`, time.Now().Unix())
+	if err != nil {
+		pm.mu.RUnlock()
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			pm.mu.RUnlock()
+			return 0, err
 		}
-
-		return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+		ids = append(ids, id)
 	}
+	rows.Close()
+	pm.mu.RUnlock()
 
-	// MobileHop: luôn change_url khi lấy proxy (không check canChangeIP)
-	if p.Type == ProxyTypeMobileHop && p.ChangeUrl != "" {
-		// Gọi callChangeURL
-		if err := pm.callChangeURL(context.Background(), p.ChangeUrl); err != nil {
-			// callChangeURL thất bại - set running=false, clear thread_id
-			errMsg := fmt.Sprintf("callChangeURL failed: %v", err)
-			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET running=false, thread_id=NULL, updated_at=? WHERE id=?`, now, p.ID)
-			if cached, ok := pm.proxyCache[p.ID]; ok {
-				cached.Running = false
-				cached.UpdatedAt = now
-			}
-			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("%s", errMsg)
+	evicted := 0
+	var result error
+	for _, id := range ids {
+		ok, err := pm.evictExpiredProxy(id)
+		if err != nil {
+			result = multierror.Append(result, err)
 		}
-
-		// callChangeURL thành công - update last_changed, reset used=1, giữ running=true, clear error
-		pm.mu.Lock()
-		pm.db.Exec(`UPDATE proxies SET last_changed=?, used=1, error='', updated_at=? WHERE id=?`, now.Unix(), now, p.ID)
-		if cached, ok := pm.proxyCache[p.ID]; ok {
-			cached.LastChanged = now
-			cached.Used = 1
-			cached.Error = ""
-			cached.UpdatedAt = now
+		if ok {
+			evicted++
 		}
-		pm.mu.Unlock()
+	}
 
-		p.LastChanged = now
-		p.Error = ""
-		p.UpdatedAt = now
+	return evicted, result
+}
 
-		// Đợi ChangeProxyWaitTime trước khi trả result
-		if pm.changeProxyWaitTime > 0 {
-			time.Sleep(pm.changeProxyWaitTime)
-		}
+// evictExpiredInterval khoảng cách tối thiểu giữa 2 lần acquireProxy tự gọi EvictExpired
+const evictExpiredInterval = 30 * time.Second
 
-		return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+// maybeEvictExpired gọi EvictExpired nếu lần gọi trước từ acquireProxy đã quá evictExpiredInterval.
+// Nhiều thread lấy proxy cùng lúc chỉ 1 thread quét, các thread khác đi tiếp
+func (pm *ProxyManager) maybeEvictExpired() {
+	now := time.Now().UnixNano()
+	last := pm.lastEvictAt.Load()
+	if last != 0 && now-last < int64(evictExpiredInterval) {
+		return
+	}
+	if !pm.lastEvictAt.CompareAndSwap(last, now) {
+		return
 	}
+	pm.EvictExpired()
+}
 
-	// KiotProxy: restart nếu đủ điều kiện
-	if p.Type == ProxyTypeKiotProxy && canChangeIP && p.ApiKey != "" {
-		// Parse region từ changeUrl nếu có
-		region := ""
-		if p.ChangeUrl != "" {
-			region = p.ChangeUrl
-		}
+// evictExpiredProxy xử lý 1 proxy hết hạn của EvictExpired, trả về true nếu proxy bị đánh dấu lỗi
+// Proxy được claimProxy trong lúc đổi IP: thread khác không lấy được proxy đang đổi, và 2 lần EvictExpired
+// chạy song song không đổi IP cùng 1 api key 2 lần
+func (pm *ProxyManager) evictExpiredProxy(id int64) (bool, error) {
+	if !pm.claimProxy(id) {
+		// Đang được sử dụng: xử lý sau khi release
+		return false, nil
+	}
+	defer pm.unclaimProxy(id)
 
-		// KiotProxy: gọi GetNewProxy
-		resp, err := service.GetKiotProxy().GetNewProxy(p.ApiKey, region)
-		if err != nil {
-			// GetNewProxy thất bại - đánh dấu error, set running=0, clear thread_id
-			errMsg := fmt.Sprintf("GetNewProxy failed: %v", err)
-			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET error=?, running=0, thread_id=NULL, updated_at=? WHERE id=?`, errMsg, now, p.ID)
-			if cached, ok := pm.proxyCache[p.ID]; ok {
-				cached.Error = errMsg
-				cached.Running = false
-				cached.UpdatedAt = now
-			}
-			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("%s", errMsg)
-		}
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	// Proxy đã được xử lý (đổi IP hoặc đánh dấu lỗi) trước khi claim
+	if p.Error != "" || p.ExpiresAt.IsZero() || p.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
 
-		if !resp.Success {
-			// API trả về error - đánh dấu error, set running=0, clear thread_id
-			errMsg := fmt.Sprintf("kiotproxy api returned code: %d, message: %s, error: %s", resp.Code, resp.Message, resp.Error)
-			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET error=?, running=0, thread_id=NULL, updated_at=? WHERE id=?`, errMsg, now, p.ID)
-			if cached, ok := pm.proxyCache[p.ID]; ok {
-				cached.Error = errMsg
-				cached.Running = false
-				cached.UpdatedAt = now
+	errMsg := fmt.Sprintf("api key expired at %s", p.ExpiresAt.Format(time.RFC3339))
+	if isProviderType(p.Type) {
+		if _, err := pm.changeProxyIP(pm.baseContext(), p); err != nil {
+			errMsg = fmt.Sprintf("%s, rotation failed: %v", errMsg, err)
+		} else {
+			pm.mu.RLock()
+			p, err = pm.getProxyByID(id)
+			pm.mu.RUnlock()
+			if err != nil {
+				return false, err
 			}
-			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("%s", errMsg)
+			if p.ExpiresAt.IsZero() || p.ExpiresAt.After(time.Now()) {
+				// Provider đã cấp proxy mới còn hạn
+				return false, nil
+			}
+			errMsg = fmt.Sprintf("api key expired at %s, rotation returned expired proxy", p.ExpiresAt.Format(time.RFC3339))
 		}
+	}
 
-		// GetNewProxy thành công - update proxy mới, reset used=1, giữ running=true, clear error
-		newProxyStr := resp.Data.HTTP
-
-		pm.mu.Lock()
-		pm.db.Exec(`UPDATE proxies SET proxy_str=?, last_changed=?, used=1, error='', updated_at=? WHERE id=?`, newProxyStr, now.Unix(), now, p.ID)
-		if cached, ok := pm.proxyCache[p.ID]; ok {
-			cached.ProxyStr = newProxyStr
-			cached.LastChanged = now
-			cached.Used = 1
-			cached.Error = ""
-			cached.UpdatedAt = now
-		}
-		pm.mu.Unlock()
+	now := time.Now()
+	pm.mu.Lock()
+	pm.db.Exec(`UPDATE proxies SET error=?, error_at=?, error_category=?, updated_at=? WHERE id=?`, errMsg, now.Unix(), errorCategoryValue(errMsg), now, id)
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.Error = errMsg
+		cached.ErrorAt = now
+		cached.UpdatedAt = now
+	}
+	pm.mu.Unlock()
+	pm.logf("[ProxyManager] Proxy %d evicted: %s\n", id, errMsg)
+	return true, nil
+}
 
-		p.ProxyStr = newProxyStr
-		p.LastChanged = now
-		p.Error = ""
-		p.UpdatedAt = now
+// eligibleRotationIDs trả về id các proxy thuộc types đủ điều kiện đổi IP:
+// không bị lỗi, không đang được sử dụng, đã đủ min_time (hoặc IP sắp hết hạn) và đã qua cooldown của provider
+func (pm *ProxyManager) eligibleRotationIDs(types ...ProxyType) ([]int64, error) {
+	placeholders := make([]string, len(types))
+	args := make([]interface{}, 0, len(types)+2)
+	for i, t := range types {
+		placeholders[i] = "?"
+		args = append(args, t)
+	}
+	now := time.Now()
+	args = append(args, now.Unix(), now.Add(ipExpiryMargin).Unix(), now.Unix())
 
-		// Restart dumbproxy instance với upstream mới (nếu IsBlockAssets=true)
-		pm.restartDumbProxyInstance(p.ID, newProxyStr)
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	rows, err := pm.db.Query(`
+		SELECT id
+		FROM proxies
+		WHERE type IN (`+strings.Join(placeholders, ", ")+`)
+			AND running=0
+			AND (error IS NULL OR error = '')
+			AND (min_time = 0 OR last_changed IS NULL OR (? - last_changed >= min_time)
+				OR (ip_expires_at > 0 AND ip_expires_at <= ?))
+			AND (next_change_at IS NULL OR next_change_at <= ?)
+		ORDER BY id ASC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		// Đợi ChangeProxyWaitTime trước khi trả result
-		if pm.changeProxyWaitTime > 0 {
-			time.Sleep(pm.changeProxyWaitTime)
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
 		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
-		return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+// warmUpConcurrency số proxy được WarmUp đồng thời
+const warmUpConcurrency = 4
+
+// WarmUp lấy sẵn IP mới (GetNewProxy) cho các proxy tmproxy/kiotproxy/ipv4xoay đủ điều kiện đổi IP
+// (không lỗi, không đang dùng, đã đủ min_time và cooldown của provider), để lần GetAvailableProxy kế tiếp
+// trả về ngay mà không phải đợi API. Chạy đồng thời tối đa warmUpConcurrency proxy, dừng khi ctx bị huỷ
+// Hữu ích ngay sau SetConfig với nhiều api key. Lỗi của từng proxy được gộp lại
+// Proxy được giữ (claimProxy) trong lúc đổi IP nên không bị cấp phát giữa chừng; huỷ ctx (hoặc Close) huỷ cả các lần gọi API đang chạy
+func (pm *ProxyManager) WarmUp(ctx context.Context) error {
+	ids, err := pm.eligibleRotationIDs(providerTypes()...)
+	if err != nil {
+		return err
 	}
+	ctx, cancel := pm.withManagerContext(ctx)
+	defer cancel()
 
-	// IPv4Xoay: restart nếu đủ điều kiện (phương án 3: retry tự động nếu bị block)
-	if p.Type == ProxyTypeIPv4Xoay && canChangeIP && p.ApiKey != "" {
-		// IPv4Xoay: gọi GetNewProxy
-		resp, err := service.GetIPv4Xoay().GetNewProxy(p.ApiKey)
-		if err != nil {
-			// GetNewProxy thất bại - đánh dấu error, set running=0, clear thread_id
-			errMsg := fmt.Sprintf("GetNewProxy failed: %v", err)
-			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET error=?, running=0, thread_id=NULL, updated_at=? WHERE id=?`, errMsg, now, p.ID)
-			if cached, ok := pm.proxyCache[p.ID]; ok {
-				cached.Error = errMsg
-				cached.Running = false
-				cached.UpdatedAt = now
-			}
-			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("%s", errMsg)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result error
+	)
+	sem := make(chan struct{}, warmUpConcurrency)
+	for _, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return multierror.Append(result, ctx.Err())
 		}
 
-		if resp == nil {
-			// Status 101 (bị block): phương án 3 - không set error, set running=0, clear thread_id, retry sau
-			pm.mu.Lock()
-			pm.db.Exec(`UPDATE proxies SET running=0, thread_id=NULL, updated_at=? WHERE id=?`, now, p.ID)
-			if cached, ok := pm.proxyCache[p.ID]; ok {
-				cached.Running = false
-				cached.UpdatedAt = now
-			}
-			pm.mu.Unlock()
-			return 0, "", fmt.Errorf("ipv4xoay api is blocking (status 101), will retry later")
-		}
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-		// Status 100: GetNewProxy thành công - update proxy mới, reset used=1, giữ running=true, clear error
-		newProxyStr := resp.ProxyHTTP
+			// Proxy đã được lấy trong lúc warm-up
+			if !pm.claimProxy(id) {
+				return
+			}
+			defer pm.unclaimProxy(id)
 
-		pm.mu.Lock()
-		pm.db.Exec(`UPDATE proxies SET proxy_str=?, last_changed=?, used=1, error='', updated_at=? WHERE id=?`, newProxyStr, now.Unix(), now, p.ID)
-		if cached, ok := pm.proxyCache[p.ID]; ok {
-			cached.ProxyStr = newProxyStr
-			cached.LastChanged = now
-			cached.Used = 1
-			cached.Error = ""
-			cached.UpdatedAt = now
-		}
-		pm.mu.Unlock()
+			pm.mu.RLock()
+			p, err := pm.getProxyByID(id)
+			pm.mu.RUnlock()
+			if err == nil {
+				_, err = pm.changeProxyIP(ctx, p)
+			}
+			if err != nil {
+				mu.Lock()
+				result = multierror.Append(result, fmt.Errorf("proxy %d: %w", id, err))
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
 
-		p.ProxyStr = newProxyStr
-		p.LastChanged = now
-		p.Error = ""
-		p.UpdatedAt = now
+	return result
+}
 
-		// Restart dumbproxy instance với upstream mới (nếu IsBlockAssets=true)
-		pm.restartDumbProxyInstance(p.ID, newProxyStr)
+// UsageRecord chứa thông tin 1 lần lấy proxy
+type UsageRecord struct {
+	ProxyID    int64
+	ThreadId   int
+	AcquiredAt time.Time
+	ReleasedAt *time.Time // nil nếu chưa release (hoặc proxy non-unique không cần release)
+}
 
-		// Đợi ChangeProxyWaitTime trước khi trả result
-		if pm.changeProxyWaitTime > 0 {
-			time.Sleep(pm.changeProxyWaitTime)
-		}
+// UsageHistory trả về lịch sử lấy proxy kể từ thời điểm since (cần bật Config.TrackUsage)
+func (pm *ProxyManager) UsageHistory(id int64, since time.Time) ([]UsageRecord, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
 
-		return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+	rows, err := pm.db.Query(`
+		SELECT proxy_id, thread_id, acquired_at, released_at
+		FROM proxy_usage
+		WHERE proxy_id=? AND acquired_at >= ?
+		ORDER BY acquired_at ASC, id ASC
+	`, id, since.Unix())
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Không đủ điều kiện restart: update used++ và trả về proxy hiện tại
-	// Auto không tăng used (không giới hạn count)
-	if p.Type != ProxyTypeAuto {
-		pm.mu.Lock()
-		pm.db.Exec(`UPDATE proxies SET used=used+1, updated_at=? WHERE id=?`, now, p.ID)
-		if cached, ok := pm.proxyCache[p.ID]; ok {
-			cached.Used = cached.Used + 1
-			cached.UpdatedAt = now
+	var records []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		var threadId sql.NullInt64
+		var acquiredAt int64
+		var releasedAt sql.NullInt64
+		if err := rows.Scan(&r.ProxyID, &threadId, &acquiredAt, &releasedAt); err != nil {
+			return nil, err
 		}
-		pm.mu.Unlock()
+		if threadId.Valid {
+			r.ThreadId = int(threadId.Int64)
+		}
+		r.AcquiredAt = time.Unix(acquiredAt, 0)
+		if releasedAt.Valid {
+			t := time.Unix(releasedAt.Int64, 0)
+			r.ReleasedAt = &t
+		}
+		records = append(records, r)
 	}
 
-	return p.ID, pm.getConnectionString(p.ID, p.ProxyStr), nil
+	return records, rows.Err()
 }
 
 // ErrorProxy chứa thông tin proxy bị lỗi
@@ -847,6 +2160,8 @@ type ErrorProxy struct {
 	ApiKey    string
 	Error     string
 	UpdatedAt time.Time
+	// Category nhóm lỗi (invalid_key, network, ...), dùng để lọc/tự động ClearProxyError lỗi tạm thời
+	Category ErrorCategory
 }
 
 // GetErrorProxies trả về danh sách các proxy đang bị lỗi
@@ -855,7 +2170,7 @@ func (pm *ProxyManager) GetErrorProxies() ([]ErrorProxy, error) {
 	defer pm.mu.RUnlock()
 
 	rows, err := pm.db.Query(`
-		SELECT id, type, proxy_str, api_key, error, updated_at
+		SELECT id, type, proxy_str, api_key, error, error_category, updated_at
 		FROM proxies
 		WHERE error IS NOT NULL AND error != ''
 		ORDER BY updated_at DESC
@@ -870,10 +2185,16 @@ func (pm *ProxyManager) GetErrorProxies() ([]ErrorProxy, error) {
 		var ep ErrorProxy
 		var apiKey sql.NullString
 		var proxyStr sql.NullString
-		err := rows.Scan(&ep.ID, &ep.Type, &proxyStr, &apiKey, &ep.Error, &ep.UpdatedAt)
+		var category sql.NullString
+		err := rows.Scan(&ep.ID, &ep.Type, &proxyStr, &apiKey, &ep.Error, &category, &ep.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
+		// Lỗi ghi trước khi có cột error_category: phân loại lại từ message
+		ep.Category = ErrorCategory(category.String)
+		if ep.Category == "" {
+			ep.Category = classifyError(ep.Error)
+		}
 		if apiKey.Valid {
 			ep.ApiKey = apiKey.String
 		}
@@ -899,9 +2220,32 @@ type ProxyRecord struct {
 	Unique      bool
 	LastIP      string
 	LastChanged time.Time
-	ThreadId    *int // Thread đang sử dụng proxy này (nil nếu không có)
+	ThreadId    *int     // Thread đang sử dụng proxy này (nil nếu không có)
+	Draining    bool     // Đang drain (DrainProxy), khác với proxy lỗi: do người vận hành chủ động tạm ngừng
+	Tags        []string // Nhóm proxy (tuỳ chọn "tag=NAME")
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
+	// Health tỉ lệ thành công của các lần sử dụng gần nhất (xem HealthScore), 1 nếu chưa có kết quả
+	Health float64
+	// DemotedUntil proxy bị hạ cấp do health score thấp tới thời điểm này (zero = không bị hạ cấp)
+	DemotedUntil time.Time
+}
+
+// IsRunning proxy có đang được giữ hay không (đã cấp phát qua GetAvailableProxy và chưa ReleaseProxy)
+// Trả về lỗi nếu proxy không tồn tại
+func (pm *ProxyManager) IsRunning(id int64) (bool, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if p, ok := pm.proxyCache[id]; ok {
+		return p.Running, nil
+	}
+	var running bool
+	err := pm.db.QueryRow(`SELECT running FROM proxies WHERE id=?`, id).Scan(&running)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("proxy %d not found", id)
+	}
+	return running, err
 }
 
 // GetAllProxies trả về danh sách tất cả proxy không bị lỗi
@@ -910,7 +2254,7 @@ func (pm *ProxyManager) GetAllProxies() ([]ProxyRecord, error) {
 	defer pm.mu.RUnlock()
 
 	rows, err := pm.db.Query(`
-		SELECT id, type, proxy_str, api_key, change_url, min_time, running, used, is_unique, last_ip, last_changed, thread_id, created_at, updated_at
+		SELECT id, type, proxy_str, api_key, change_url, min_time, running, used, is_unique, last_ip, last_changed, thread_id, draining, tags, demoted_until, created_at, updated_at
 		FROM proxies
 		WHERE error IS NULL OR error = ''
 		ORDER BY id ASC
@@ -929,7 +2273,9 @@ func (pm *ProxyManager) GetAllProxies() ([]ProxyRecord, error) {
 		var lastIP sql.NullString
 		var lastChangedUnix sql.NullInt64
 		var threadId sql.NullInt64
-		err := rows.Scan(&p.ID, &p.Type, &proxyStr, &apiKey, &changeUrl, &p.MinTime, &p.Running, &p.Used, &p.Unique, &lastIP, &lastChangedUnix, &threadId, &p.CreatedAt, &p.UpdatedAt)
+		var tags sql.NullString
+		var demotedUntil sql.NullInt64
+		err := rows.Scan(&p.ID, &p.Type, &proxyStr, &apiKey, &changeUrl, &p.MinTime, &p.Running, &p.Used, &p.Unique, &lastIP, &lastChangedUnix, &threadId, &p.Draining, &tags, &demotedUntil, &p.CreatedAt, &p.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -952,24 +2298,183 @@ func (pm *ProxyManager) GetAllProxies() ([]ProxyRecord, error) {
 			tid := int(threadId.Int64)
 			p.ThreadId = &tid
 		}
+		p.Tags = decodeTags(tags.String)
+		if demotedUntil.Valid && demotedUntil.Int64 > 0 {
+			p.DemotedUntil = time.Unix(demotedUntil.Int64, 0)
+		}
+		p.Health = pm.health[p.ID].score()
 		proxies = append(proxies, p)
 	}
 
 	return proxies, nil
 }
 
+// DownProviders trả về các provider (tmproxy/kiotproxy/ipv4xoay) mà toàn bộ proxy đều đang bị lỗi
+// Dùng để cảnh báo provider ngừng hoạt động (hết hạn/khoá toàn bộ api key)
+func (pm *ProxyManager) DownProviders() []ProxyType {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.downProvidersLocked()
+}
+
+// downProvidersLocked giống DownProviders nhưng caller phải giữ pm.mu
+func (pm *ProxyManager) downProvidersLocked() []ProxyType {
+	var down []ProxyType
+	for _, provider := range providerTypes() {
+		total, errored := 0, 0
+		for _, p := range pm.proxyCache {
+			if p.Type != provider {
+				continue
+			}
+			total++
+			if p.Error != "" {
+				errored++
+			}
+		}
+		if total > 0 && errored == total {
+			down = append(down, provider)
+		}
+	}
+	return down
+}
+
+// ProxyHolder trả về threadId đang giữ proxy (set khi GetAvailableProxy, clear khi ReleaseProxy)
+// held=false nếu proxy không được giữ (hoặc là proxy non-unique, không gắn với thread nào)
+// Dùng để tìm worker quên ReleaseProxy
+func (pm *ProxyManager) ProxyHolder(id int64) (threadId int, held bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var tid sql.NullInt64
+	if err := pm.db.QueryRow(`SELECT thread_id FROM proxies WHERE id=? AND running=1`, id).Scan(&tid); err != nil || !tid.Valid {
+		return 0, false
+	}
+	return int(tid.Int64), true
+}
+
+// DrainProxy ngừng cấp phát proxy cho lần lấy mới nhưng không xoá proxy (giữ lịch sử),
+// thread đang giữ vẫn dùng và ReleaseProxy bình thường. Gọi UndrainProxy để cấp phát lại
+func (pm *ProxyManager) DrainProxy(id int64) error {
+	return pm.setDraining(id, true)
+}
+
+// UndrainProxy cho phép cấp phát lại proxy đã DrainProxy
+func (pm *ProxyManager) UndrainProxy(id int64) error {
+	return pm.setDraining(id, false)
+}
+
+func (pm *ProxyManager) setDraining(id int64, draining bool) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	now := time.Now()
+	result, err := pm.db.Exec(`UPDATE proxies SET draining=?, updated_at=? WHERE id=?`, draining, now, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("proxy %d not found", id)
+	}
+
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.Draining = draining
+		cached.UpdatedAt = now
+	}
+
+	return nil
+}
+
+// AutoRecover xoá lỗi của các proxy đã lỗi lâu hơn Config.ErrorCooldown để chúng quay lại pool
+// (GetAllProxies, RotateAllEligible, WarmUp...). GetAvailableProxy tự gọi trước mỗi lần chọn proxy
+// Trả về số proxy được khôi phục. ErrorCooldown = 0: không làm gì
+func (pm *ProxyManager) AutoRecover() (int, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.errorCooldown <= 0 {
+		return 0, nil
+	}
+	return pm.autoRecoverLocked(time.Now())
+}
+
+// autoRecoverLocked giống AutoRecover nhưng caller phải giữ pm.mu
+// Proxy lỗi từ trước khi có cột error_at (error_at NULL) được coi là đã hết cooldown
+func (pm *ProxyManager) autoRecoverLocked(now time.Time) (int, error) {
+	deadline := now.Add(-pm.errorCooldown).Unix()
+	rows, err := pm.db.Query(`
+		SELECT id
+		FROM proxies
+		WHERE error IS NOT NULL AND error != '' AND COALESCE(error_at, 0) <= ?
+	`, deadline)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := pm.db.Exec(`UPDATE proxies SET error='', error_at=NULL, updated_at=? WHERE id=?`, now, id); err != nil {
+			return 0, err
+		}
+		if cached, ok := pm.proxyCache[id]; ok {
+			cached.Error = ""
+			cached.ErrorAt = time.Time{}
+			cached.UpdatedAt = now
+		}
+		pm.logf("[ProxyManager] Proxy %d: error cleared after ErrorCooldown\n", id)
+	}
+	return len(ids), nil
+}
+
+// ResetUsage bắt đầu "vòng" mới trên pool hiện tại: set used=0, running=false cho tất cả proxy
+// Khác SetConfig: không parse lại proxy string, không gọi API provider, không xoá lỗi
+// Proxy standby (PrefetchPerThread) và IP chuẩn bị sẵn (ProactiveRotation) bị bỏ như SetConfig
+func (pm *ProxyManager) ResetUsage() error {
+	pm.lockWithoutPendingStandby()
+	pm.standby = make(map[int]*standbyProxy)
+	pm.standbyMu.Unlock()
+	defer pm.mu.Unlock()
+
+	pm.stagedMu.Lock()
+	pm.staged = make(map[int64]*stagedRotation)
+	pm.stagedMu.Unlock()
+
+	now := time.Now()
+	if _, err := pm.db.Exec(`UPDATE proxies SET used=0, running=false, thread_id=NULL, running_since=NULL, updated_at=?`, now); err != nil {
+		return err
+	}
+	for _, p := range pm.proxyCache {
+		p.Used = 0
+		p.Running, p.RunningSince, p.UpdatedAt = false, time.Time{}, now
+	}
+	if pm.trackUsage {
+		pm.db.Exec(`UPDATE proxy_usage SET released_at=? WHERE released_at IS NULL`, now.Unix())
+	}
+	pm.logf("[ProxyManager] Usage reset for all proxies\n")
+	pm.notifyRelease()
+	return nil
+}
+
 // ClearProxyError xóa lỗi của proxy để có thể sử dụng lại
 func (pm *ProxyManager) ClearProxyError(id int64) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	_, err := pm.db.Exec(`UPDATE proxies SET error='', updated_at=? WHERE id=?`, time.Now(), id)
+	_, err := pm.db.Exec(`UPDATE proxies SET error='', error_at=NULL, updated_at=? WHERE id=?`, time.Now(), id)
 	if err != nil {
 		return err
 	}
 
 	if cached, ok := pm.proxyCache[id]; ok {
 		cached.Error = ""
+		cached.ErrorAt = time.Time{}
 		cached.UpdatedAt = time.Now()
 	}
 
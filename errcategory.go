@@ -0,0 +1,58 @@
+package goproxy
+
+import "strings"
+
+// ErrorCategory nhóm lỗi của proxy (ErrorProxy.Category), phân loại từ error message khi lỗi được ghi
+type ErrorCategory string
+
+const (
+	ErrorCategoryUnknown      ErrorCategory = "unknown"        // không phân loại được
+	ErrorCategoryInvalidKey   ErrorCategory = "invalid_key"    // provider từ chối api key (sai key, hết lượt, bị khoá)
+	ErrorCategoryExpired      ErrorCategory = "expired"        // api key đã hết hạn
+	ErrorCategoryIPNotAllowed ErrorCategory = "ip_not_allowed" // IP của máy không có trong whitelist của api key (tmproxy ip_allow)
+	ErrorCategoryNetwork      ErrorCategory = "network"        // không gọi được API provider/change_url (mất mạng, timeout, HTTP 5xx, ...)
+	ErrorCategoryInstance     ErrorCategory = "instance"       // không khởi động được dumbproxy instance (port bị chiếm, ...)
+)
+
+// Transient lỗi tạm thời, có thể tự hết khi thử lại (tự động ClearProxyError được)
+// Lỗi còn lại (invalid_key, expired, ip_not_allowed, unknown) cần người vận hành xử lý
+func (c ErrorCategory) Transient() bool {
+	return c == ErrorCategoryNetwork || c == ErrorCategoryInstance
+}
+
+// classifyError phân loại error message của proxy (theo các message do package và service tạo ra)
+func classifyError(errMsg string) ErrorCategory {
+	msg := strings.ToLower(errMsg)
+	containsAny := func(subs ...string) bool {
+		for _, s := range subs {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case containsAny("not in ip_allow"):
+		return ErrorCategoryIPNotAllowed
+	case containsAny("failed to start dumbproxy instance"):
+		return ErrorCategoryInstance
+	case containsAny("api key expired"):
+		return ErrorCategoryExpired
+	case containsAny("failed to send request", "failed to read response", "failed to unmarshal response",
+		"timeout", "deadline exceeded", "connection refused", "connection reset", "no such host", "eof",
+		"provider unreachable", "response too large", "callchangeurl failed", "api returned status "):
+		// "api returned status N": HTTP status lỗi từ API provider, khác "status: N" của ipv4xoay (key bị từ chối)
+		return ErrorCategoryNetwork
+	case containsAny("invalid api key", "api returned code", "api returned error", "api returned status:", "has no api key"):
+		return ErrorCategoryInvalidKey
+	}
+	return ErrorCategoryUnknown
+}
+
+// errorCategoryValue giá trị cột error_category tương ứng với error (NULL nếu không lỗi)
+func errorCategoryValue(errMsg string) interface{} {
+	if errMsg == "" {
+		return nil
+	}
+	return string(classifyError(errMsg))
+}
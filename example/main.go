@@ -39,26 +39,23 @@ func main() {
 	fmt.Println()
 
 	// Lấy proxy (threadId = 1)
-	proxyID, proxyStr, err := pm.GetAvailableProxy(1)
+	lease, err := pm.GetAvailableProxyInfo(1)
 	if err != nil {
 		log.Fatalf("Failed to get available proxy: %v", err)
 	}
 
 	fmt.Println("=== Proxy Info ===")
-	fmt.Printf("ID: %d\n", proxyID)
-	fmt.Printf("ProxyStr (ConnectionInfo): %s\n", proxyStr)
+	fmt.Printf("ID: %d\n", lease.ID)
+	fmt.Printf("ProxyStr (ConnectionInfo): %s\n", lease.ConnectionString)
 	fmt.Println()
 
-	// Kiểm tra kết quả
+	// Kiểm tra kết quả: LocalAddr là địa chỉ mà dumbproxy instance thực sự listen
 	if config.IsBlockAssets {
-		expectedPort := 20000 + int(proxyID)
-		expectedConnectionInfo := fmt.Sprintf("127.0.0.1:%d", expectedPort)
-
 		fmt.Println("=== Verification ===")
-		fmt.Printf("Expected ConnectionInfo: %s\n", expectedConnectionInfo)
-		fmt.Printf("Actual ConnectionInfo: %s\n", proxyStr)
+		fmt.Printf("Local instance address: %s (port %d)\n", lease.LocalAddr, lease.LocalPort)
+		fmt.Printf("Actual ConnectionInfo: %s\n", lease.ConnectionString)
 
-		if proxyStr == expectedConnectionInfo {
+		if lease.LocalAddr != "" && lease.ConnectionString == lease.LocalAddr {
 			fmt.Println("SUCCESS: ConnectionInfo is correct!")
 			fmt.Println()
 			fmt.Println("Khi IsBlockAssets = true:")
@@ -1,10 +1,16 @@
 package goproxy
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/tuwibu/goproxy/service"
 )
 
 // ProxyType định nghĩa loại proxy
@@ -20,33 +26,150 @@ const (
 	ProxyTypeIPv4Xoay  ProxyType = "ipv4xoay"
 )
 
+// SelectionStrategy định nghĩa thứ tự ưu tiên khi chọn proxy trong GetAvailableProxy
+type SelectionStrategy string
+
+const (
+	StrategyLeastUsed    SelectionStrategy = "least_used"    // mặc định: ưu tiên proxy có used thấp nhất
+	StrategyFastestFirst SelectionStrategy = "fastest_first" // ưu tiên proxy có latency thấp nhất (proxy chưa đo latency xếp sau)
+	// StrategyWeightedRandom chọn ngẫu nhiên trong các proxy đủ điều kiện, xác suất tỉ lệ với weight (tuỳ chọn "weight=N", mặc định 1)
+	StrategyWeightedRandom SelectionStrategy = "weighted_random"
+)
+
+// ErrNoAvailableProxy trả về khi không có proxy nào đủ điều kiện (kể cả sau khi đợi AcquireWait)
+var ErrNoAvailableProxy = errors.New("no available proxy")
+
+// ErrResponseTooLarge trả về khi response của provider/endpoint kiểm tra vượt quá Config.MaxResponseBytes
+var ErrResponseTooLarge = service.ErrResponseTooLarge
+
+// ProviderDownError trả về (thay cho ErrNoAvailableProxy) khi không có proxy nào khả dụng
+// và toàn bộ proxy của 1 hoặc nhiều provider (tmproxy/kiotproxy/ipv4xoay) đều đang bị lỗi
+// errors.Is(err, ErrNoAvailableProxy) vẫn trả về true
+type ProviderDownError struct {
+	Providers []ProxyType
+}
+
+func (e *ProviderDownError) Error() string {
+	names := make([]string, len(e.Providers))
+	for i, p := range e.Providers {
+		names[i] = string(p)
+	}
+	return fmt.Sprintf("%v: all proxies of provider %s are errored", ErrNoAvailableProxy, strings.Join(names, ", "))
+}
+
+func (e *ProviderDownError) Unwrap() error {
+	return ErrNoAvailableProxy
+}
+
+// acquirePollInterval khoảng thời gian giữa các lần thử lại khi đợi proxy (AcquireWait)
+const acquirePollInterval = 50 * time.Millisecond
+
 // Proxy đại diện cho một proxy entry
 type Proxy struct {
-	ID          int64
-	Type        ProxyType
-	ProxyStr    string
-	ApiKey      string
-	ChangeUrl   string
-	MinTime     int  // thời gian tối thiểu giữa các lần thay đổi (giây)
-	Running     bool // cờ chỉ proxy có đang được sử dụng hay không
-	Used        int  // số lần proxy đã được sử dụng
-	Unique      bool // có check running hay không (tmproxy/mobilehop/static=true, sticky=tùy chỉnh)
-	LastChanged time.Time
-	LastIP      string
-	Error       string // lỗi nếu GetNewProxy thất bại
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID                  int64
+	Type                ProxyType
+	ProxyStr            string
+	ApiKey              string
+	ChangeUrl           string
+	MinTime             int  // thời gian tối thiểu giữa các lần thay đổi (giây)
+	Running             bool // cờ chỉ proxy có đang được sử dụng hay không
+	Used                int  // số lần proxy đã được sử dụng
+	Unique              bool // có check running hay không (tmproxy/mobilehop/static=true, sticky=tùy chỉnh)
+	LastChanged         time.Time
+	LastIP              string
+	Error               string        // lỗi nếu GetNewProxy thất bại
+	Latency             time.Duration // latency trung bình (EWMA) ghi nhận qua ReportResult/CheckLatency, 0 = chưa đo
+	Location            string        // vị trí proxy do provider trả về (tmproxy/kiotproxy/ipv4xoay)
+	ISP                 string        // nhà mạng do provider trả về
+	ExpiresAt           time.Time     // thời điểm hết hạn của api key (zero nếu không rõ)
+	NextChangeAt        time.Time     // thời điểm sớm nhất provider cho phép đổi IP (zero nếu không rõ)
+	FreshSessionEachUse bool          // sticky unique: mỗi lần lấy đều tạo session mới (bỏ qua maxUsed/min_time)
+	ParallelSessions    bool          // api key cho phép nhiều session song song (cờ "parallel"), dùng cho ProactiveRotation
+	IDLocation          int           // tmproxy: id_location khi GetNewProxy (tuỳ chọn "location=N", 0 = ngẫu nhiên)
+	IDISP               int           // tmproxy: id_isp khi GetNewProxy (tuỳ chọn "isp=N", 0 = ngẫu nhiên)
+	NhaMang             string        // ipv4xoay: nhà mạng khi lấy proxy (tuỳ chọn "nhamang=NAME", "" = random)
+	TinhThanh           string        // ipv4xoay: tỉnh thành khi lấy proxy (tuỳ chọn "tinhthanh=N", "" = 0 ngẫu nhiên)
+	ReadyAt             time.Time     // NonBlockingChangeWait: proxy vừa đổi IP chỉ được cấp phát từ thời điểm này (zero = sẵn sàng)
+	Tags                []string      // nhóm proxy (tuỳ chọn "tag=NAME"), dùng cho GetAvailableProxyByTag
+	ChangeRequest       ChangeRequest // mobilehop: method/header/body riêng khi gọi change_url (ghép với Config.ChangeRequest)
+	Draining            bool          // đang drain (DrainProxy): không cấp phát mới, người đang giữ vẫn dùng/trả bình thường
+	Weight              float64       // trọng số khi chọn proxy với StrategyWeightedRandom (tuỳ chọn "weight=N", mặc định 1)
+	ErrorAt             time.Time     // thời điểm set Error (zero nếu không lỗi hoặc không rõ)
+	IPExpiresAt         time.Time     // thời điểm IP hiện tại hết hạn (kiotproxy: ttl), zero nếu không rõ
+	DemotedUntil        time.Time     // health score thấp: không được cấp phát tới thời điểm này (zero = không bị hạ cấp)
+	RunningSince        time.Time     // thời điểm proxy được cấp phát (zero nếu không đang được giữ), dùng cho LeaseTTL
+	ThreadId            *int          // thread đang giữ proxy (nil nếu không có hoặc đang được giữ nội bộ, vd: đổi IP), chỉ có trong ListProxies
+	SOCKS5              bool          // provider: dùng proxy SOCKS5 (kèm user/pass) thay cho HTTP (cờ "socks5")
+	HTTPStr             string        // provider: proxy HTTP của IP hiện tại ("" nếu provider không cấp)
+	SOCKS5Str           string        // provider: proxy SOCKS5 của IP hiện tại dạng socks5://host:port:user:pass ("" nếu không cấp)
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
 }
 
 // ProxyManager quản lý danh sách proxy (Singleton)
 type ProxyManager struct {
-	db                  *sql.DB
-	mu                  sync.RWMutex
-	changeProxyWaitTime time.Duration
-	maxUsed             int
-	isBlockAssets       bool // Cờ đánh dấu có bật chế độ block assets hay không
-	proxyCache          map[int64]*Proxy
-	initialized         bool
+	db                     *sql.DB
+	queryConn              *sql.Conn  // Connection riêng (PRAGMA query_only) của Query, mở khi Query được gọi lần đầu
+	queryMu                sync.Mutex // Bảo vệ queryConn
+	mu                     sync.RWMutex
+	changeProxyWaitTime    time.Duration
+	changeURLTimeout       time.Duration // Timeout cho mỗi lần gọi change_url (mobilehop)
+	changeRequest          ChangeRequest // Method/header/body mặc định khi gọi change_url
+	maxUsed                int
+	strategy               SelectionStrategy
+	nonUniqueMaxUsed       int                       // Giới hạn số lần dùng chung 1 session cho proxy non-unique (0 = mỗi lần lấy 1 session mới)
+	isBlockAssets          bool                      // Cờ đánh dấu có bật chế độ block assets hay không
+	trackUsage             bool                      // Ghi lịch sử lấy/trả proxy vào bảng proxy_usage
+	stickyTokenLen         int                       // Độ dài token thay cho {random} (0 = mặc định 8)
+	stickyTokenAlphabet    string                    // Bộ ký tự của token ("" = hex)
+	showProxyCredentials   bool                      // Không che user/pass trong log
+	stickySessionPerThread bool                      // Session sticky cố định theo threadId
+	sessionSalt            string                    // Salt ngẫu nhiên để session của mỗi process khác nhau
+	threadSessionGen       map[int]int               // Số lần RotateStickySession của từng thread
+	sessionMu              sync.Mutex                // Bảo vệ threadSessionGen, hostSessions
+	hostSessions           map[string]*hostSession   // Session sticky theo target host (GetAvailableProxyForHost)
+	nonBlockingChangeWait  bool                      // ChangeProxyWaitTime không block: proxy vừa đổi IP trả về pool tới ready_at
+	hostAffinityTTL        time.Duration             // Thời gian giữ session của 1 host kể từ lần dùng cuối
+	prefetchPerThread      bool                      // Lấy sẵn proxy tiếp theo cho thread khi release
+	acquireWait            time.Duration             // Thời gian tối đa đợi proxy rảnh trước khi trả ErrNoAvailableProxy
+	rotationJitter         time.Duration             // Độ trễ ngẫu nhiên tối đa cộng thêm vào min_time của mỗi proxy
+	errorCooldown          time.Duration             // Proxy lỗi lâu hơn khoảng này được tự động xoá lỗi (0 = không tự khôi phục)
+	logger                 Logger                    // Nhận log của package (nil = không log)
+	metrics                *poolMetrics              // Counter cho MetricsHandler
+	tmproxyAutoAuthorizeIP bool                      // Tự động thêm IP hiện tại vào ip_allow của tmproxy
+	proactiveRotation      bool                      // Chuẩn bị sẵn IP tiếp theo cho proxy đang sử dụng
+	staged                 map[int64]*stagedRotation // IP chuẩn bị sẵn theo proxy id
+	stagedMu               sync.Mutex                // Bảo vệ staged
+	standby                map[int]*standbyProxy     // Proxy standby theo threadId
+	standbyMu              sync.Mutex                // Bảo vệ standby
+	proxyCache             map[int64]*Proxy
+	stickySessions         map[int64]string   // Session hiện tại của proxy non-unique (chỉ dùng khi nonUniqueMaxUsed > 0)
+	scheduleCancel         context.CancelFunc // Huỷ lịch rotation của ScheduleRotation
+	watchCancel            context.CancelFunc // Huỷ theo dõi ProxyFile (WatchProxyFile)
+	ctx                    context.Context    // Bị huỷ khi Close: dừng các lần gọi change_url/provider đang chạy hoặc retry
+	cancel                 context.CancelFunc // Huỷ ctx
+	initialized            bool
+
+	// Health score theo proxy id (kết quả gần nhất qua ReportResult/ReportFailure)
+	health          map[int64]*healthRing
+	healthThreshold float64       // Hạ cấp proxy có health score thấp hơn (0 = tắt)
+	healthCooldown  time.Duration // Thời gian proxy bị hạ cấp (0 = defaultHealthCooldown)
+
+	// Số lần đổi IP qua provider tối đa của 1 api key trong 1 giờ (0 = không giới hạn)
+	maxRotationsPerHour int
+	// min_time mặc định (giây) theo loại proxy cho dòng không có min_time
+	defaultMinTimes map[ProxyType]int
+	// Proxy được giữ lâu hơn khoảng này bị thu hồi về pool (0 = không thu hồi)
+	leaseTTL time.Duration
+	// Số proxy tối đa trong pool, LoadProxiesFromList xoá bớt proxy cũ khi vượt quá (0 = không giới hạn)
+	maxPoolSize int
+
+	// Được đóng (và thay bằng channel mới) mỗi khi có proxy trả về pool, đánh thức GetAvailableProxyWait
+	releaseCh chan struct{}
+	releaseMu sync.Mutex // Bảo vệ releaseCh
+
+	// Thời điểm (UnixNano) acquireProxy tự gọi EvictExpired lần gần nhất (0 = chưa gọi kể từ SetConfig/ReloadConfig)
+	lastEvictAt atomic.Int64
 }
 
 var (
@@ -58,25 +181,39 @@ var (
 func GetInstance() (*ProxyManager, error) {
 	var err error
 	once.Do(func() {
-		instance, err = newProxyManager()
+		instance, err = NewProxyManager(SQLiteOpener{Path: "proxy.db"})
 	})
 	return instance, err
 }
 
-// newProxyManager khởi tạo ProxyManager mới
-func newProxyManager() (*ProxyManager, error) {
-	db, err := initDB("proxy.db")
+// NewProxyManager khởi tạo ProxyManager độc lập với singleton, database được mở qua opener
+func NewProxyManager(opener DBOpener) (*ProxyManager, error) {
+	db, err := opener.Open()
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	pm := &ProxyManager{
-		db:         db,
-		proxyCache: make(map[int64]*Proxy),
+		ctx:              ctx,
+		cancel:           cancel,
+		db:               db,
+		proxyCache:       make(map[int64]*Proxy),
+		stickySessions:   make(map[int64]string),
+		health:           make(map[int64]*healthRing),
+		sessionSalt:      generateRandomString(16),
+		threadSessionGen: make(map[int]int),
+		hostSessions:     make(map[string]*hostSession),
+		standby:          make(map[int]*standbyProxy),
+		staged:           make(map[int64]*stagedRotation),
+		logger:           noopLogger{},
+		metrics:          newPoolMetrics(),
+		releaseCh:        make(chan struct{}),
 	}
 
 	// Khởi tạo schema
 	if err := pm.initSchema(); err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
@@ -89,65 +226,385 @@ func (pm *ProxyManager) validateProxyType(t ProxyType) error {
 	case ProxyTypeTMProxy, ProxyTypeStatic, ProxyTypeMobileHop, ProxyTypeSticky, ProxyTypeKiotProxy, ProxyTypeAuto, ProxyTypeIPv4Xoay:
 		return nil
 	}
+	if isProviderType(t) {
+		return nil
+	}
 	return fmt.Errorf("invalid type: %s", t)
 }
 
 type Config struct {
 	ChangeProxyWaitTime time.Duration
+	ChangeURLTimeout    time.Duration // Timeout cho mỗi lần gọi change_url (mobilehop), mặc định 60s
 	ProxyStrings        []string
 	ClearAllProxy       bool
 	MaxUsed             int
-	IsBlockAssets       bool // Nếu true, tạo local dumbproxy instance để block static assets
+	SelectionStrategy   SelectionStrategy // Thứ tự ưu tiên khi chọn proxy, mặc định StrategyLeastUsed
+	// NonUniqueMaxUsed giới hạn số lần dùng chung 1 session cho proxy non-unique (sticky unique=false)
+	// Proxy non-unique bỏ qua MaxUsed/running, mặc định (0) mỗi lần lấy sẽ tạo session mới (thay {random})
+	// Nếu > 0: giữ nguyên session cho tối đa N lần lấy, sau đó mới tạo session mới
+	NonUniqueMaxUsed int
+	IsBlockAssets    bool // Nếu true, tạo local dumbproxy instance để block static assets
+	TrackUsage       bool // Nếu true, ghi lịch sử lấy/trả proxy (xem UsageHistory)
+	// StickyTokenLen độ dài token thay cho {random}/${random} của sticky proxy, mặc định 8
+	// Dùng placeholder {session:N} để chỉ định độ dài riêng trong từng proxy string
+	StickyTokenLen int
+	// StickyTokenAlphabet bộ ký tự dùng để sinh token, mặc định hex (0-9a-f)
+	StickyTokenAlphabet string
+	// ShowProxyCredentials nếu true, log hiển thị đầy đủ user/pass của proxy (chỉ dùng khi debug)
+	// Mặc định user/pass được che thành "***"
+	ShowProxyCredentials bool
+	// StickySessionPerThread nếu true, {random}/{session:N} của sticky proxy được sinh cố định theo threadId,
+	// cùng 1 thread luôn nhận cùng session (cùng IP) cho tới khi gọi RotateStickySession(threadId)
+	StickySessionPerThread bool
+	// PrefetchPerThread nếu true, khi thread release proxy sẽ lấy sẵn (giữ running) proxy tiếp theo cho thread đó,
+	// lần GetAvailableProxy kế tiếp của thread trả về ngay proxy standby. Đổi lại mỗi thread giữ thêm 1 proxy
+	PrefetchPerThread bool
+	// AcquireWait nếu > 0, GetAvailableProxy thử lại (mỗi 50ms) trong tối đa AcquireWait khi chưa có proxy rảnh
+	// trước khi trả về ErrNoAvailableProxy. Mặc định 0: trả lỗi ngay
+	AcquireWait time.Duration
+	// RotationJitter nếu > 0, min_time của mỗi proxy được cộng thêm 1 khoảng ngẫu nhiên trong [0, RotationJitter)
+	// (cố định trong mỗi chu kỳ đổi IP, khác nhau giữa các proxy) để các proxy cùng min_time nạp cùng lúc
+	// không gọi GetNewProxy đồng loạt. Jitter chỉ làm chậm, không bao giờ rút ngắn min_time. Proxy min_time = 0 không bị ảnh hưởng
+	RotationJitter time.Duration
+	// ErrorCooldown nếu > 0, proxy bị lỗi không được cấp phát trong ErrorCooldown kể từ lúc lỗi, sau đó lỗi được tự động xoá
+	// (lần GetAvailableProxy kế tiếp hoặc AutoRecover) để proxy quay lại pool, tránh pool bị thu hẹp vĩnh viễn do provider lỗi tạm thời.
+	// Mặc định 0: lỗi giữ nguyên tới khi ClearProxyError hoặc đổi IP thành công
+	ErrorCooldown time.Duration
+	// NonBlockingChangeWait nếu true, sau khi đổi IP GetAvailableProxy không sleep ChangeProxyWaitTime
+	// mà trả proxy về pool (chỉ được cấp phát lại sau ChangeProxyWaitTime) và lấy ngay proxy khác cho caller.
+	// Không còn proxy nào thì trả ErrNoAvailableProxy (hoặc đợi theo AcquireWait). Mặc định false: sleep như cũ
+	NonBlockingChangeWait bool
+	// Logger nhận log của package (lỗi khởi động dumbproxy instance, lỗi gọi API provider, cảnh báo cấu hình)
+	// Có thể truyền log.Default() hoặc *log.Logger bất kỳ. Mặc định nil: không log
+	Logger Logger
+	// TMProxyAutoAuthorizeIP nếu true, khi IP public hiện tại không có trong ip_allow của tmproxy api key
+	// sẽ tự động gọi AuthorizeIP thay vì đánh dấu lỗi "current IP not in ip_allow list"
+	TMProxyAutoAuthorizeIP bool
+	// ProactiveRotation nếu true, khi lấy proxy tmproxy/kiotproxy/ipv4xoay có cờ "parallel" (api key cho phép nhiều session song song),
+	// IP tiếp theo được chuẩn bị sẵn ở nền trong lúc proxy đang dùng. Khi đủ min_time, lần lấy sau chuyển sang IP đó ngay
+	// mà không phải đợi GetNewProxy. Không bật cho api key không hỗ trợ (GetNewProxy sẽ làm hỏng IP đang dùng)
+	ProactiveRotation bool
+	// HostAffinityTTL thời gian giữ session sticky của 1 target host trong GetAvailableProxyForHost,
+	// tính từ lần dùng cuối. Mặc định (0) là 30 phút
+	HostAffinityTTL time.Duration
+	// ChangeRequest method/header/body mặc định khi gọi change_url của mobilehop (mặc định GET không header)
+	// Proxy string có thể ghi đè bằng "method=POST", "header=Name: value", "body=..."
+	ChangeRequest ChangeRequest
+	// MaxInstances giới hạn số dumbproxy instance chạy cùng lúc khi IsBlockAssets (0 = mỗi proxy 1 instance, khởi động hết khi SetConfig)
+	// Nếu > 0: SetConfig chỉ khởi động MaxInstances instance đầu tiên, proxy còn lại được khởi động khi GetAvailableProxy
+	// (dừng instance rảnh lâu nhất nếu đã đủ). Hết instance rảnh thì GetAvailableProxy trả ErrNoAvailableProxy
+	MaxInstances int
+	// InstanceIdleTTL dừng dumbproxy instance của proxy không được cấp phát quá thời gian này (kiểm tra khi GetAvailableProxy)
+	// Mặc định 0: không dừng
+	InstanceIdleTTL time.Duration
+	// DialFamily giới hạn address family cho kết nối của dumbproxy instance (IsBlockAssets): "auto" (mặc định), "ipv4", "ipv6"
+	// Áp dụng cho kết nối direct (static assets) và kết nối tới upstream proxy, hostname không có địa chỉ thuộc family sẽ báo lỗi
+	DialFamily string
+	// Resolver DNS server riêng cho dumbproxy instance (IsBlockAssets) thay cho resolver của hệ thống, tránh DNS leak/poisoning:
+	// DoH URL ("https://cloudflare-dns.com/dns-query"), DoT ("tls://1.1.1.1") hoặc host:port ("8.8.8.8:53"). Mặc định "": resolver hệ thống
+	Resolver string
+	// DisableAcceptHeuristic nếu true, dumbproxy instance (IsBlockAssets) chỉ coi request là static asset theo extension/path,
+	// không dựa vào Accept header (image/, video/, audio/, font/). Tránh API call có Accept rộng bị đi direct ngoài proxy
+	DisableAcceptHeuristic bool
+	// UpstreamPaths chuỗi con của path (không phân biệt hoa thường) buộc request đi upstream dù trông như static asset
+	// (extension, Accept header, thư mục asset), vd: "/api/images/logo.png" mặc định đi upstream.
+	// nil = mặc định []string{"/api/"}, slice rỗng []string{} = không buộc path nào
+	UpstreamPaths []string
+	// IgnoreAssetQuery nếu true, request trong thư mục asset (/static/, /images/, ...) luôn đi direct (trừ UpstreamPaths),
+	// không còn coi query có "callback" (JSONP) là dynamic. Mặc định false
+	IgnoreAssetQuery bool
+	// DebugRoutingStats nếu true, dumbproxy instance (IsBlockAssets) đếm số kết nối đi direct/upstream theo host,
+	// xem bằng GetDumbProxyManager().InstanceRoutingStats(proxyID) để tinh chỉnh heuristic static asset. Chỉ bật khi debug
+	DebugRoutingStats bool
+	// LocalProtocol giao thức cổng local của dumbproxy instance (IsBlockAssets): "http" (mặc định) hoặc "socks5".
+	// Với "socks5", GetAvailableProxy trả về "socks5://127.0.0.1:port" thay cho "127.0.0.1:port"
+	LocalProtocol string
+	// LocalBindAddr IP local dùng làm địa chỉ nguồn cho kết nối đi ra của dumbproxy instance (IsBlockAssets),
+	// cả direct và tới upstream, để chọn NIC trên máy nhiều địa chỉ mạng. Mặc định "": do hệ điều hành chọn.
+	// SetConfig trả về lỗi nếu không phải IP hoặc IP không bind được trên máy
+	LocalBindAddr string
+	// DialTimeout timeout kết nối đi ra của dumbproxy instance (IsBlockAssets), cả direct và tới upstream.
+	// Upstream chậm/không phản hồi không làm treo CONNECT quá thời gian này. Mặc định (0): không timeout
+	DialTimeout time.Duration
+	// KeepAlive chu kỳ TCP keepalive của kết nối đi ra của dumbproxy instance. Mặc định (0) 15s, âm = tắt
+	KeepAlive time.Duration
+	// IdleConnTimeout đóng kết nối keep-alive tới cổng local HTTP của dumbproxy instance không có request
+	// quá thời gian này. Mặc định (0): không đóng
+	IdleConnTimeout time.Duration
+	// AccessLog nếu khác nil, nhận 1 AccessLogEntry cho mỗi CONNECT/HTTP request đi qua cổng local HTTP của
+	// dumbproxy instance (IsBlockAssets): host đích, số byte, status và route (direct/upstream). Dùng để debug
+	// worker truy cập những site nào. Được gọi đồng thời từ nhiều kết nối. Mặc định nil: tắt
+	AccessLog func(AccessLogEntry)
+	// UpstreamTLSSkipVerify bỏ qua kiểm tra chứng chỉ khi dumbproxy instance kết nối tới upstream qua TLS
+	// (proxy string có tiền tố https://, vd: "static|https://host:port:user:pass"). Chỉ bật cho proxy
+	// của provider dùng chứng chỉ tự ký. Mặc định false: kiểm tra chứng chỉ như HTTPS thông thường
+	UpstreamTLSSkipVerify bool
+	// MaxResponseBytes giới hạn kích thước response đọc từ API provider và endpoint kiểm tra proxy,
+	// vượt quá trả về ErrResponseTooLarge. Mặc định (0) là 4MB
+	MaxResponseBytes int64
+	// HealthThreshold hạ cấp proxy có health score (tỉ lệ thành công của 20 lần sử dụng gần nhất, ghi qua
+	// ReportResult/ReportFailure và các lần đổi IP thất bại) thấp hơn ngưỡng này, vd: 0.5.
+	// Proxy bị hạ cấp không được cấp phát trong HealthCooldown. Mặc định 0: tắt
+	HealthThreshold float64
+	// HealthCooldown thời gian proxy bị hạ cấp do health score thấp. Mặc định (0) là 5 phút
+	HealthCooldown time.Duration
+	// MaxRotationsPerHour số lần đổi IP qua provider (tmproxy/kiotproxy/ipv4xoay/...) tối đa của 1 api key
+	// trong 1 giờ gần nhất (cửa sổ trượt, lưu trong db nên không bị reset khi restart). Khi đạt giới hạn,
+	// GetAvailableProxy trả về IP hiện tại thay vì đổi IP, ForceChange trả về ErrRotationLimit.
+	// Mặc định 0: không giới hạn
+	MaxRotationsPerHour int
+	// DefaultMinTimes min_time mặc định (giây) theo loại proxy, dùng khi dòng proxy không có min_time,
+	// vd: {ProxyTypeKiotProxy: 130}. min_time của dòng (kể cả 0) luôn được ưu tiên hơn giá trị mặc định
+	DefaultMinTimes map[ProxyType]int
+	// LeaseTTL nếu > 0, proxy được cấp phát (running) lâu hơn LeaseTTL mà chưa ReleaseProxy bị thu hồi về pool
+	// (lần GetAvailableProxy kế tiếp hoặc ReclaimStaleLeases), tránh mất proxy khi caller crash.
+	// Chọn giá trị lớn hơn thời gian giữ proxy lâu nhất của caller. Mặc định 0: không thu hồi
+	LeaseTTL time.Duration
+	// MaxPoolSize nếu > 0, số proxy tối đa trong pool. Khi load (SetConfig/ReloadConfig/LoadProxiesFromList) làm pool
+	// vượt quá, các proxy không đang được giữ và không có trong danh sách vừa load bị xoá (kèm dumbproxy instance),
+	// ưu tiên proxy used cao nhất rồi tới proxy lâu không được cập nhật nhất. Mặc định 0: không giới hạn
+	MaxPoolSize int
+	// ProxyFile đường dẫn file danh sách proxy (mỗi dòng 1 hoặc nhiều proxy cách nhau bởi dấu phẩy,
+	// bỏ qua dòng trống và dòng bắt đầu bằng #, giống LoadProxiesFromString), ghép sau ProxyStrings
+	ProxyFile string
+	// WatchProxyFile nếu true, theo dõi mtime của ProxyFile và tự ReloadConfig (không xoá pool) khi file thay đổi
+	WatchProxyFile bool
+	// PreserveState nếu true (và ClearAllProxy = false), SetConfig chỉ thêm các dòng chưa có trong pool (theo unique_key),
+	// không reset used/running/error của proxy đã có, proxy đang được giữ vẫn được giữ. Dòng đã có trong pool được
+	// bỏ qua (không cập nhật min_time/tag=/...), proxy không có trong ProxyStrings vẫn được giữ lại (khác ReloadConfig).
+	// ClearAllProxy = true thì PreserveState bị bỏ qua. Mặc định false: SetConfig reset trạng thái của toàn bộ pool
+	PreserveState bool
+	// MaxConnsPerInstance giới hạn số kết nối (CONNECT tunnel/HTTP request) đồng thời qua cổng local của mỗi
+	// dumbproxy instance (IsBlockAssets, LocalProtocol "http"), tránh 1 IP của provider nhận quá nhiều kết nối cùng lúc
+	// và bị chặn. Vượt quá thì trả 503 ngay. Mặc định 0: không giới hạn
+	MaxConnsPerInstance int
 }
 
 func (pm *ProxyManager) SetConfig(config Config) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.changeProxyWaitTime = config.ChangeProxyWaitTime
+	proxyStrings, err := configProxyStrings(config)
+	if err != nil {
+		return err
+	}
+	watchConfig := config
+	config.ProxyStrings = proxyStrings
+	if err := pm.applyConfigLocked(config); err != nil {
+		return err
+	}
+
+	preserve := config.PreserveState && !config.ClearAllProxy
+	if !preserve {
+		// Running của mọi proxy bị reset nên bỏ các proxy standby đang giữ
+		pm.standbyMu.Lock()
+		pm.standby = make(map[int]*standbyProxy)
+		pm.standbyMu.Unlock()
+		pm.stagedMu.Lock()
+		pm.staged = make(map[int64]*stagedRotation)
+		pm.stagedMu.Unlock()
+	}
 
 	// Nếu IsBlockAssets thay đổi hoặc ClearAllProxy, dừng tất cả dumbproxy instances
 	// StopAll sẽ stop instances + kill zombie ports
-	if config.ClearAllProxy || pm.isBlockAssets != config.IsBlockAssets {
+	blockAssetsChanged := pm.isBlockAssets != config.IsBlockAssets
+	if config.ClearAllProxy || blockAssetsChanged {
 		GetDumbProxyManager().StopAll()
 	}
 
 	pm.isBlockAssets = config.IsBlockAssets
+	pm.nonUniqueMaxUsed = config.NonUniqueMaxUsed
+	if !preserve {
+		pm.stickySessions = make(map[int64]string)
+		pm.sessionMu.Lock()
+		pm.hostSessions = make(map[string]*hostSession)
+		pm.sessionMu.Unlock()
+	}
+
+	// PreserveState: proxy đã có trong pool giữ nguyên, chỉ load dòng mới
+	var existing []int64
+	if preserve {
+		config.ProxyStrings, existing = pm.newProxyLinesLocked(config.ProxyStrings)
+	}
 
 	if config.ClearAllProxy {
 		pm.db.Exec("DELETE FROM proxies")
+		pm.db.Exec("DELETE FROM proxy_usage")
 		pm.proxyCache = make(map[int64]*Proxy)
-	} else {
+	} else if !preserve {
 		// Reset tất cả proxy: used=0, running=false, error=''
-		pm.db.Exec("UPDATE proxies SET used=0, running=false, error='', updated_at=?", time.Now())
+		pm.db.Exec("UPDATE proxies SET used=0, running=false, running_since=NULL, error='', demoted_until=NULL, updated_at=?", time.Now())
 		for _, p := range pm.proxyCache {
 			p.Used = 0
 			p.Running = false
 			p.Error = ""
+			p.DemotedUntil = time.Time{}
 			p.UpdatedAt = time.Now()
 		}
 	}
+	if !preserve {
+		pm.health = make(map[int64]*healthRing)
+	}
 
-	ids, err := pm.LoadProxiesFromList(config.ProxyStrings)
-	if err != nil {
-		return fmt.Errorf("failed to load proxies: %w", err)
+	// Dòng proxy lỗi chỉ log cảnh báo, các dòng hợp lệ vẫn được load
+	ids, _, lineErrs := pm.LoadProxiesFromList(config.ProxyStrings)
+	for _, lineErr := range lineErrs {
+		pm.logf("[ProxyManager] Warning: skipped proxy %s (input: %s)\n", lineErr, pm.displayProxyLine(lineErr.Input))
 	}
 
 	// Nếu IsBlockAssets được bật, khởi động dumbproxy instances
+	// MaxInstances > 0: chỉ khởi động tối đa MaxInstances instance, các proxy còn lại khởi động khi được cấp phát
+	GetDumbProxyManager().SetLimits(config.MaxInstances, config.InstanceIdleTTL)
 	if config.IsBlockAssets {
-		for _, id := range ids {
-			if proxy, ok := pm.proxyCache[id]; ok && proxy.ProxyStr != "" {
-				addr, err := GetDumbProxyManager().StartInstance(id, proxy.ProxyStr)
-				if err != nil {
-					// Log error nhưng tiếp tục
-					fmt.Printf("[DumbProxy] Failed to start instance for proxy %d: %v\n", id, err)
-					continue
-				}
-				fmt.Printf("[DumbProxy] Started instance for proxy %d at %s (upstream: %s)\n", id, addr, proxy.ProxyStr)
-			}
+		if preserve && blockAssetsChanged {
+			// Instance của proxy đã có trong pool vừa bị dừng (hoặc chưa từng chạy)
+			pm.startInstancesLocked(append(existing, ids...), config.MaxInstances)
+		} else {
+			pm.startInstancesLocked(ids, config.MaxInstances)
 		}
 	}
 
 	// Lưu MaxUsed vào ProxyManager (thêm field mới)
 	pm.maxUsed = config.MaxUsed
+
+	// Cảnh báo: pool chỉ gồm proxy non-unique thì MaxUsed không có tác dụng
+	if config.MaxUsed > 0 && config.NonUniqueMaxUsed == 0 && len(ids) > 0 {
+		allNonUnique := true
+		for _, id := range ids {
+			if proxy, ok := pm.proxyCache[id]; ok && proxy.Unique {
+				allNonUnique = false
+				break
+			}
+		}
+		if allNonUnique {
+			pm.logf("[ProxyManager] Warning: MaxUsed=%d has no effect, all proxies are non-unique (set NonUniqueMaxUsed to cap session usage)\n", config.MaxUsed)
+		}
+	}
+
+	pm.watchProxyFileLocked(watchConfig)
 	return nil
 }
+
+// newProxyLinesLocked lọc các dòng proxy chưa có trong pool (theo unique_key) cho SetConfig với PreserveState,
+// trả về kèm id của toàn bộ proxy đang có trong pool. Dòng sai format được giữ lại để LoadProxiesFromList báo lỗi.
+// Caller phải giữ pm.mu
+func (pm *ProxyManager) newProxyLinesLocked(proxyStrings []string) ([]string, []int64) {
+	rows, err := pm.db.Query(`SELECT id, unique_key FROM proxies ORDER BY id ASC`)
+	if err != nil {
+		return proxyStrings, nil
+	}
+	var ids []int64
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var id int64
+		var uniqueKey string
+		if err := rows.Scan(&id, &uniqueKey); err != nil {
+			break
+		}
+		ids = append(ids, id)
+		existing[uniqueKey] = true
+	}
+	rows.Close()
+
+	var lines []string
+	for _, s := range proxyStrings {
+		parts := strings.Split(strings.TrimSpace(s), "|")
+		if len(parts) >= 2 && pm.validateProxyType(ProxyType(parts[0])) == nil {
+			if key, err := expandAPIKey(parts[1]); err == nil && existing[proxyUniqueKey(ProxyType(parts[0]), key)] {
+				continue
+			}
+		}
+		lines = append(lines, s)
+	}
+	return lines, ids
+}
+
+// applyConfigLocked áp dụng các tuỳ chọn của config (không đụng tới pool proxy), caller phải giữ pm.mu
+func (pm *ProxyManager) applyConfigLocked(config Config) error {
+	for t, minTime := range config.DefaultMinTimes {
+		if err := pm.validateProxyType(t); err != nil {
+			return fmt.Errorf("invalid DefaultMinTimes: %w", err)
+		}
+		if minTime < 0 {
+			return fmt.Errorf("invalid DefaultMinTimes: negative min_time %d for %s", minTime, t)
+		}
+	}
+	if err := GetDumbProxyManager().SetDialFamily(config.DialFamily); err != nil {
+		return err
+	}
+	if err := GetDumbProxyManager().SetResolver(config.Resolver); err != nil {
+		return err
+	}
+	GetDumbProxyManager().SetAcceptHeuristic(!config.DisableAcceptHeuristic)
+	GetDumbProxyManager().SetUpstreamPaths(config.UpstreamPaths)
+	GetDumbProxyManager().SetIgnoreAssetQuery(config.IgnoreAssetQuery)
+	GetDumbProxyManager().SetRoutingStats(config.DebugRoutingStats)
+	if err := GetDumbProxyManager().SetLocalProtocol(config.LocalProtocol); err != nil {
+		return err
+	}
+	if err := GetDumbProxyManager().SetLocalBindAddr(config.LocalBindAddr); err != nil {
+		return err
+	}
+	GetDumbProxyManager().SetTimeouts(config.DialTimeout, config.KeepAlive, config.IdleConnTimeout)
+	GetDumbProxyManager().SetUpstreamTLSSkipVerify(config.UpstreamTLSSkipVerify)
+	GetDumbProxyManager().SetAccessLog(config.AccessLog)
+	GetDumbProxyManager().SetMaxConns(config.MaxConnsPerInstance)
+	pm.changeProxyWaitTime = config.ChangeProxyWaitTime
+	pm.changeURLTimeout = config.ChangeURLTimeout
+	pm.changeRequest = config.ChangeRequest
+	pm.strategy = config.SelectionStrategy
+	pm.trackUsage = config.TrackUsage
+	pm.stickyTokenLen = config.StickyTokenLen
+	pm.stickyTokenAlphabet = config.StickyTokenAlphabet
+	pm.showProxyCredentials = config.ShowProxyCredentials
+	pm.stickySessionPerThread = config.StickySessionPerThread
+	pm.prefetchPerThread = config.PrefetchPerThread
+	pm.acquireWait = config.AcquireWait
+	pm.rotationJitter = config.RotationJitter
+	pm.errorCooldown = config.ErrorCooldown
+	pm.tmproxyAutoAuthorizeIP = config.TMProxyAutoAuthorizeIP
+	pm.proactiveRotation = config.ProactiveRotation
+	pm.hostAffinityTTL = config.HostAffinityTTL
+	pm.nonBlockingChangeWait = config.NonBlockingChangeWait
+	pm.healthThreshold = config.HealthThreshold
+	pm.healthCooldown = config.HealthCooldown
+	pm.maxRotationsPerHour = config.MaxRotationsPerHour
+	pm.leaseTTL = config.LeaseTTL
+	pm.maxPoolSize = config.MaxPoolSize
+	pm.defaultMinTimes = make(map[ProxyType]int, len(config.DefaultMinTimes))
+	for t, minTime := range config.DefaultMinTimes {
+		pm.defaultMinTimes[t] = minTime
+	}
+	service.SetMaxResponseBytes(config.MaxResponseBytes)
+	pm.logger = config.Logger
+	if pm.logger == nil {
+		pm.logger = noopLogger{}
+	}
+	GetDumbProxyManager().SetLogger(pm.logger)
+	pm.lastEvictAt.Store(0)
+	return nil
+}
+
+// startInstancesLocked khởi động dumbproxy instance cho các proxy ids (tối đa maxInstances instance nếu > 0)
+// Proxy không khởi động được instance bị đánh dấu lỗi, instance được khởi động lại khi proxy được cấp phát
+func (pm *ProxyManager) startInstancesLocked(ids []int64, maxInstances int) {
+	for _, id := range ids {
+		if maxInstances > 0 && GetDumbProxyManager().GetInstanceCount() >= maxInstances {
+			break
+		}
+		if proxy, ok := pm.proxyCache[id]; ok && proxy.ProxyStr != "" {
+			addr, err := GetDumbProxyManager().StartInstance(id, proxy.ProxyStr)
+			if err != nil {
+				// Đánh dấu lỗi (xem GetErrorProxies) nhưng tiếp tục
+				errMsg := fmt.Sprintf("failed to start dumbproxy instance: %v", err)
+				pm.logf("[DumbProxy] Proxy %d: %s\n", id, errMsg)
+				now := time.Now()
+				pm.db.Exec(`UPDATE proxies SET error=?, error_at=?, error_category=?, updated_at=? WHERE id=?`, errMsg, now.Unix(), errorCategoryValue(errMsg), now, id)
+				proxy.Error = errMsg
+				proxy.ErrorAt = now
+				proxy.UpdatedAt = now
+				continue
+			}
+			pm.logf("[DumbProxy] Started instance for proxy %d at %s (upstream: %s)\n", id, addr, pm.displayProxyStr(proxy.ProxyStr))
+		}
+	}
+}
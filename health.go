@@ -0,0 +1,110 @@
+package goproxy
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// healthWindow số kết quả gần nhất của mỗi proxy được dùng để tính health score
+const healthWindow = 20
+
+// healthMinSamples số kết quả tối thiểu trước khi proxy có thể bị hạ cấp (tránh hạ cấp vì 1-2 lỗi đầu tiên)
+const healthMinSamples = 5
+
+// defaultHealthCooldown thời gian proxy bị hạ cấp nếu Config.HealthCooldown = 0
+const defaultHealthCooldown = 5 * time.Minute
+
+// healthRing kết quả thành công/thất bại gần nhất của 1 proxy (vòng tròn healthWindow phần tử)
+type healthRing struct {
+	outcomes [healthWindow]bool
+	n        int // số kết quả đang có (tối đa healthWindow)
+	next     int // vị trí ghi kết quả tiếp theo
+}
+
+func (r *healthRing) record(ok bool) {
+	r.outcomes[r.next] = ok
+	r.next = (r.next + 1) % healthWindow
+	if r.n < healthWindow {
+		r.n++
+	}
+}
+
+// score tỉ lệ thành công trong cửa sổ, 1 nếu chưa có kết quả nào
+func (r *healthRing) score() float64 {
+	if r == nil || r.n == 0 {
+		return 1
+	}
+	ok := 0
+	for i := 0; i < r.n; i++ {
+		if r.outcomes[i] {
+			ok++
+		}
+	}
+	return float64(ok) / float64(r.n)
+}
+
+// ReportFailure ghi nhận 1 lần sử dụng proxy thất bại (timeout, bị chặn, ...) vào health score
+// Khác với error của proxy: proxy vẫn ở trong pool, chỉ bị hạ cấp tạm thời nếu health score
+// xuống dưới HealthThreshold (xem Config.HealthThreshold)
+func (pm *ProxyManager) ReportFailure(id int64) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var exists int
+	if err := pm.db.QueryRow(`SELECT 1 FROM proxies WHERE id=?`, id).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("proxy %d not found", id)
+		}
+		return err
+	}
+	pm.recordHealthLocked(id, false, time.Now())
+	return nil
+}
+
+// HealthScore trả về tỉ lệ thành công của healthWindow lần sử dụng gần nhất của proxy (1 nếu chưa có kết quả)
+// và số kết quả đang được tính. Kết quả được ghi qua ReportResult (thành công), ReportFailure và
+// các lần đổi IP thất bại
+func (pm *ProxyManager) HealthScore(id int64) (score float64, samples int) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	r := pm.health[id]
+	if r == nil {
+		return 1, 0
+	}
+	return r.score(), r.n
+}
+
+// recordHealthLocked ghi 1 kết quả vào health của proxy, hạ cấp proxy nếu score xuống dưới HealthThreshold
+// Proxy bị hạ cấp không được GetAvailableProxy cấp phát tới hết HealthCooldown. Caller phải giữ pm.mu
+func (pm *ProxyManager) recordHealthLocked(id int64, ok bool, now time.Time) {
+	r, exists := pm.health[id]
+	if !exists {
+		r = &healthRing{}
+		pm.health[id] = r
+	}
+	r.record(ok)
+
+	if ok || pm.healthThreshold <= 0 || r.n < healthMinSamples {
+		return
+	}
+	score := r.score()
+	if score >= pm.healthThreshold {
+		return
+	}
+	if cached, ok := pm.proxyCache[id]; ok && cached.DemotedUntil.After(now) {
+		return
+	}
+
+	cooldown := pm.healthCooldown
+	if cooldown <= 0 {
+		cooldown = defaultHealthCooldown
+	}
+	until := now.Add(cooldown)
+	pm.db.Exec(`UPDATE proxies SET demoted_until=?, updated_at=? WHERE id=?`, until.Unix(), now, id)
+	if cached, ok := pm.proxyCache[id]; ok {
+		cached.DemotedUntil = until
+		cached.UpdatedAt = now
+	}
+	pm.logf("[ProxyManager] Proxy %d demoted until %s: health %.2f < %.2f\n", id, until.Format(time.RFC3339), score, pm.healthThreshold)
+}
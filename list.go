@@ -0,0 +1,100 @@
+package goproxy
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// ListOptions bộ lọc và phân trang của ListProxies, zero value = tất cả proxy
+type ListOptions struct {
+	Types    []ProxyType // chỉ lấy các loại proxy này (rỗng = mọi loại)
+	Running  *bool       // true: đang được sử dụng, false: đang rảnh, nil: không lọc
+	HasError *bool       // true: đang lỗi, false: không lỗi, nil: không lọc
+	Offset   int         // bỏ qua Offset proxy đầu tiên (theo id tăng dần)
+	Limit    int         // số proxy tối đa trả về (0 = không giới hạn)
+}
+
+// ListProxies trả về proxy (kể cả đang chạy, rảnh, lỗi) kèm toàn bộ trạng thái và thread đang giữ (ThreadId), sắp xếp theo id
+// Mỗi phần tử là bản sao đọc từ db, sửa không ảnh hưởng tới pool
+func (pm *ProxyManager) ListProxies(opts ListOptions) ([]Proxy, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("invalid pagination: offset=%d, limit=%d", opts.Offset, opts.Limit)
+	}
+
+	var where []string
+	var args []interface{}
+	if len(opts.Types) > 0 {
+		placeholders := make([]string, len(opts.Types))
+		for i, t := range opts.Types {
+			placeholders[i] = "?"
+			args = append(args, string(t))
+		}
+		where = append(where, "type IN ("+strings.Join(placeholders, ",")+")")
+	}
+	if opts.Running != nil {
+		where = append(where, "running=?")
+		args = append(args, *opts.Running)
+	}
+	if opts.HasError != nil {
+		if *opts.HasError {
+			where = append(where, "(error IS NOT NULL AND error != '')")
+		} else {
+			where = append(where, "(error IS NULL OR error = '')")
+		}
+	}
+
+	query := `SELECT id, thread_id FROM proxies`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id ASC"
+	if opts.Limit > 0 || opts.Offset > 0 {
+		// SQLite: LIMIT -1 = không giới hạn
+		limit := opts.Limit
+		if limit == 0 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, opts.Offset)
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	rows, err := pm.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	holders := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var threadId sql.NullInt64
+		if err := rows.Scan(&id, &threadId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		if threadId.Valid {
+			holders[id] = int(threadId.Int64)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	proxies := make([]Proxy, 0, len(ids))
+	for _, id := range ids {
+		p, err := pm.getProxyByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if threadId, ok := holders[id]; ok {
+			p.ThreadId = &threadId
+		}
+		proxies = append(proxies, *p)
+	}
+	return proxies, nil
+}
@@ -0,0 +1,31 @@
+package goproxy
+
+import (
+	"strings"
+)
+
+// Logger nhận log của package (các lỗi khởi động dumbproxy instance, lỗi gọi API provider, cảnh báo cấu hình)
+// *log.Logger của thư viện chuẩn thỏa mãn interface này
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// noopLogger bỏ qua mọi log (mặc định khi Config.Logger = nil)
+type noopLogger struct{}
+
+func (noopLogger) Printf(format string, v ...interface{}) {}
+
+// logWriter chuyển io.Writer sang Logger (dùng cho log.Logger của dumbproxy handler)
+type logWriter struct {
+	logger Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Printf("%s", strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// logf ghi log qua Config.Logger
+func (pm *ProxyManager) logf(format string, v ...interface{}) {
+	pm.logger.Printf(format, v...)
+}
@@ -0,0 +1,156 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// poolMetrics các counter của ProxyManager (gauge được tính từ proxyCache khi scrape)
+type poolMetrics struct {
+	mu           sync.Mutex
+	loaded       map[ProxyType]uint64 // số proxy được load qua LoadProxiesFromList
+	acquisitions map[ProxyType]uint64 // số lần lấy proxy thành công
+	rotations    map[ProxyType]uint64 // số lần đổi IP/session thành công
+	apiFailures  map[ProxyType]uint64 // số lần gọi API provider (hoặc change_url) thất bại
+}
+
+func newPoolMetrics() *poolMetrics {
+	return &poolMetrics{
+		loaded:       make(map[ProxyType]uint64),
+		acquisitions: make(map[ProxyType]uint64),
+		rotations:    make(map[ProxyType]uint64),
+		apiFailures:  make(map[ProxyType]uint64),
+	}
+}
+
+func (m *poolMetrics) inc(counter map[ProxyType]uint64, t ProxyType) {
+	m.mu.Lock()
+	counter[t]++
+	m.mu.Unlock()
+}
+
+func (m *poolMetrics) load(t ProxyType)       { m.inc(m.loaded, t) }
+func (m *poolMetrics) acquire(t ProxyType)    { m.inc(m.acquisitions, t) }
+func (m *poolMetrics) rotation(t ProxyType)   { m.inc(m.rotations, t) }
+func (m *poolMetrics) apiFailure(t ProxyType) { m.inc(m.apiFailures, t) }
+
+// snapshot copy counter để format mà không giữ lock
+func (m *poolMetrics) snapshot(counter map[ProxyType]uint64) map[ProxyType]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[ProxyType]uint64, len(counter))
+	for t, v := range counter {
+		out[t] = v
+	}
+	return out
+}
+
+// MetricsHandler trả về http.Handler phục vụ metrics của pool theo Prometheus text format
+// Gauge: goproxy_proxies, goproxy_proxies_running, goproxy_proxies_errored, goproxy_proxies_demoted (label type)
+// Counter: goproxy_proxies_loaded_total, goproxy_acquisitions_total, goproxy_rotations_total (label type),
+// goproxy_api_failures_total (label provider)
+func (pm *ProxyManager) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, pm.formatMetrics())
+	})
+}
+
+// formatMetrics format toàn bộ metrics theo Prometheus text format
+func (pm *ProxyManager) formatMetrics() string {
+	total := make(map[ProxyType]uint64)
+	running := make(map[ProxyType]uint64)
+	errored := make(map[ProxyType]uint64)
+	demoted := make(map[ProxyType]uint64)
+	now := time.Now()
+	pm.mu.RLock()
+	for _, p := range pm.proxyCache {
+		total[p.Type]++
+		if p.Running {
+			running[p.Type]++
+		}
+		if p.Error != "" {
+			errored[p.Type]++
+		}
+		if p.DemotedUntil.After(now) {
+			demoted[p.Type]++
+		}
+	}
+	pm.mu.RUnlock()
+
+	var b strings.Builder
+	writeMetric(&b, "goproxy_proxies", "gauge", "Number of proxies in the pool.", "type", total)
+	writeMetric(&b, "goproxy_proxies_running", "gauge", "Number of proxies currently held by a thread.", "type", running)
+	writeMetric(&b, "goproxy_proxies_errored", "gauge", "Number of proxies marked with an error.", "type", errored)
+	writeMetric(&b, "goproxy_proxies_demoted", "gauge", "Number of proxies demoted for a low health score.", "type", demoted)
+	writeMetric(&b, "goproxy_proxies_loaded_total", "counter", "Total proxies loaded from proxy strings.", "type", pm.metrics.snapshot(pm.metrics.loaded))
+	writeMetric(&b, "goproxy_acquisitions_total", "counter", "Total successful proxy acquisitions.", "type", pm.metrics.snapshot(pm.metrics.acquisitions))
+	writeMetric(&b, "goproxy_rotations_total", "counter", "Total successful IP/session rotations.", "type", pm.metrics.snapshot(pm.metrics.rotations))
+	writeMetric(&b, "goproxy_api_failures_total", "counter", "Total failed provider API (or change_url) calls.", "provider", pm.metrics.snapshot(pm.metrics.apiFailures))
+	return b.String()
+}
+
+// writeMetric ghi 1 metric (HELP, TYPE và các sample theo label, sắp xếp theo label)
+func writeMetric(b *strings.Builder, name, metricType, help, label string, values map[ProxyType]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, metricType)
+
+	keys := make([]string, 0, len(values))
+	for t := range values {
+		keys = append(keys, string(t))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", name, label, k, values[ProxyType(k)])
+	}
+}
+
+// Utilization trả về tỉ lệ proxy unique đang được sử dụng: running / tổng số proxy unique (0 nếu pool rỗng)
+// Proxy non-unique (sticky unique=false) không giới hạn số thread nên không tính
+func (pm *ProxyManager) Utilization() float64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	total, running := 0, 0
+	for _, p := range pm.proxyCache {
+		if !p.Unique {
+			continue
+		}
+		total++
+		if p.Running {
+			running++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(running) / float64(total)
+}
+
+// UtilizationByType giống Utilization nhưng tính riêng cho từng loại proxy
+func (pm *ProxyManager) UtilizationByType() map[ProxyType]float64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	total := make(map[ProxyType]int)
+	running := make(map[ProxyType]int)
+	for _, p := range pm.proxyCache {
+		if !p.Unique {
+			continue
+		}
+		total[p.Type]++
+		if p.Running {
+			running[p.Type]++
+		}
+	}
+
+	result := make(map[ProxyType]float64, len(total))
+	for t, n := range total {
+		result[t] = float64(running[t]) / float64(n)
+	}
+	return result
+}
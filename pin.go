@@ -0,0 +1,50 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrProxyBusy proxy được chỉ định (AcquireSpecific) đang được thread khác giữ
+var ErrProxyBusy = errors.New("proxy is in use")
+
+// ErrProxyErrored proxy được chỉ định (AcquireSpecific) đang bị đánh dấu lỗi
+var ErrProxyErrored = errors.New("proxy has an error")
+
+// AcquireSpecific giống GetAvailableProxy nhưng lấy đúng proxy id thay vì để ProxyManager chọn
+// (vd: worker cần luôn dùng 1 IP ra để tái hiện lỗi). Vẫn áp dụng điều kiện running/used/min_time
+// và đổi IP nếu đủ điều kiện như GetAvailableProxy. Trả về lỗi:
+// - ErrProxyBusy: proxy đang được giữ (ReleaseProxy để dùng lại)
+// - ErrProxyErrored: proxy đang lỗi (ClearProxyError hoặc đợi ErrorCooldown)
+// - ErrNoAvailableProxy: proxy chưa đủ điều kiện (hết MaxUsed chưa đủ min_time, đang drain, bị hạ cấp, ...)
+// NonBlockingChangeWait: proxy vừa đổi IP chỉ được đợi ChangeProxyWaitTime 1 lần, vẫn chưa lấy được thì trả về ErrNoAvailableProxy
+func (pm *ProxyManager) AcquireSpecific(threadId int, id int64) (string, error) {
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	if p.Error != "" {
+		return "", fmt.Errorf("proxy %d: %w: %s", id, ErrProxyErrored, p.Error)
+	}
+	if p.Unique && p.Running {
+		return "", fmt.Errorf("proxy %d: %w", id, ErrProxyBusy)
+	}
+
+	_, proxyStr, err := pm.acquireProxy(threadId, "", id)
+	if errors.Is(err, errProxyWarming) {
+		// NonBlockingChangeWait: proxy vừa đổi IP đã trả về pool, đợi hết ChangeProxyWaitTime rồi lấy lại 1 lần
+		// (thread khác có thể lấy mất trong lúc đợi, khi đó trả về lỗi thay vì đợi tiếp)
+		time.Sleep(pm.changeProxyWaitTime)
+		_, proxyStr, err = pm.acquireProxy(threadId, "", id)
+		if errors.Is(err, errProxyWarming) {
+			err = ErrNoAvailableProxy
+		}
+	}
+	if errors.Is(err, ErrNoAvailableProxy) {
+		return "", fmt.Errorf("proxy %d: %w", id, err)
+	}
+	return proxyStr, err
+}
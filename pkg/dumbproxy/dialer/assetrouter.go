@@ -63,11 +63,23 @@ var staticAssetExtensions = map[string]bool{
 	".map": true,
 }
 
+// DefaultUpstreamPaths are the path substrings that force a request upstream
+// unless overridden with SetUpstreamPaths.
+var DefaultUpstreamPaths = []string{"/api/"}
+
 // AssetRoutingDialer routes requests based on content type
 // Static assets go through direct connection, other requests go through upstream proxy
 type AssetRoutingDialer struct {
 	directDialer   Dialer // For static assets (direct connection)
 	upstreamDialer Dialer // For other requests (via upstream proxy)
+	ignoreAccept   bool   // Classify by extension/path only, ignore the Accept header
+	ignoreQuery    bool   // Do not treat a "callback" query parameter as dynamic content
+
+	// Lowercase path substrings that always route upstream
+	upstreamPaths []string
+
+	// Per-host tallies of routing decisions, nil when disabled
+	stats *RoutingStats
 }
 
 // NewAssetRoutingDialer creates a new AssetRoutingDialer
@@ -75,7 +87,44 @@ func NewAssetRoutingDialer(direct, upstream Dialer) *AssetRoutingDialer {
 	return &AssetRoutingDialer{
 		directDialer:   direct,
 		upstreamDialer: upstream,
+		upstreamPaths:  DefaultUpstreamPaths,
+	}
+}
+
+// SetAcceptHeuristic enables or disables treating requests whose Accept header
+// asks for image/video/audio/font content as static assets. It is enabled by
+// default; API calls with a broad Accept header are routed direct unless it is
+// disabled. Must be called before the dialer is used.
+func (d *AssetRoutingDialer) SetAcceptHeuristic(enabled bool) {
+	d.ignoreAccept = !enabled
+}
+
+// SetUpstreamPaths replaces the list of path substrings (matched case
+// insensitively) that force a request upstream even when it looks like a
+// static asset. The default is DefaultUpstreamPaths; an empty list disables
+// the check. Must be called before the dialer is used.
+func (d *AssetRoutingDialer) SetUpstreamPaths(paths []string) {
+	upstreamPaths := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p != "" {
+			upstreamPaths = append(upstreamPaths, strings.ToLower(p))
+		}
 	}
+	d.upstreamPaths = upstreamPaths
+}
+
+// SetIgnoreQuery makes the asset directory heuristic (/static/, /images/, ...)
+// ignore the query string. By default a "callback" query parameter marks the
+// request as dynamic (JSONP) and routes it upstream. Must be called before
+// the dialer is used.
+func (d *AssetRoutingDialer) SetIgnoreQuery(ignore bool) {
+	d.ignoreQuery = ignore
+}
+
+// SetRoutingStats records every routing decision into stats (nil disables
+// recording). Must be called before the dialer is used.
+func (d *AssetRoutingDialer) SetRoutingStats(stats *RoutingStats) {
+	d.stats = stats
 }
 
 // isStaticAsset checks if the request is for a static asset
@@ -86,8 +135,16 @@ func (d *AssetRoutingDialer) isStaticAsset(ctx context.Context) bool {
 		return false
 	}
 
-	// Check URL path extension
+	// Paths that always go upstream (API endpoints), whatever the extension
 	urlPath := req.URL.Path
+	lowerPath := strings.ToLower(urlPath)
+	for _, p := range d.upstreamPaths {
+		if strings.Contains(lowerPath, p) {
+			return false
+		}
+	}
+
+	// Check URL path extension
 	ext := strings.ToLower(path.Ext(urlPath))
 	if staticAssetExtensions[ext] {
 		return true
@@ -95,7 +152,7 @@ func (d *AssetRoutingDialer) isStaticAsset(ctx context.Context) bool {
 
 	// Check Accept header for media types
 	accept := req.Header.Get("Accept")
-	if accept != "" {
+	if accept != "" && !d.ignoreAccept {
 		if strings.Contains(accept, "image/") ||
 			strings.Contains(accept, "video/") ||
 			strings.Contains(accept, "audio/") ||
@@ -106,7 +163,6 @@ func (d *AssetRoutingDialer) isStaticAsset(ctx context.Context) bool {
 	}
 
 	// Check for common CDN/asset paths
-	lowerPath := strings.ToLower(urlPath)
 	if strings.Contains(lowerPath, "/assets/") ||
 		strings.Contains(lowerPath, "/static/") ||
 		strings.Contains(lowerPath, "/images/") ||
@@ -116,21 +172,34 @@ func (d *AssetRoutingDialer) isStaticAsset(ctx context.Context) bool {
 		strings.Contains(lowerPath, "/js/") ||
 		strings.Contains(lowerPath, "/media/") {
 
-		// Additional check: ensure it's not an API call masquerading as static
-		if !strings.Contains(lowerPath, "/api/") {
-			// Check if URL has query params that suggest dynamic content
-			if req.URL.RawQuery == "" || !strings.Contains(req.URL.RawQuery, "callback") {
-				return true
-			}
+		// Check if URL has query params that suggest dynamic content (JSONP)
+		if d.ignoreQuery || !strings.Contains(req.URL.RawQuery, "callback") {
+			return true
 		}
 	}
 
 	return false
 }
 
-// DialContext dials with context, routing based on asset type
+// DialContext dials with context, routing based on asset type unless the
+// request carries a route override (see dto.RouteOverrideToContext)
 func (d *AssetRoutingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	if d.isStaticAsset(ctx) {
+	var direct bool
+	switch dto.RouteOverrideFromContext(ctx) {
+	case dto.RouteForceUpstream:
+		direct = false
+	case dto.RouteForceDirect:
+		direct = true
+	default:
+		direct = d.isStaticAsset(ctx)
+	}
+	if d.stats != nil {
+		d.stats.record(address, direct)
+	}
+	if rec := dto.RouteRecordFromContext(ctx); rec != nil {
+		rec.Set(direct)
+	}
+	if direct {
 		return d.directDialer.DialContext(ctx, network, address)
 	}
 	return d.upstreamDialer.DialContext(ctx, network, address)
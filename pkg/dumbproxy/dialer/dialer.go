@@ -2,6 +2,7 @@ package dialer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -26,11 +27,16 @@ type Dialer interface {
 func ProxyDialerFromURL(proxyURL string, forward Dialer) (Dialer, error) {
 	parsedURL, err := url.Parse(proxyURL)
 	if err != nil {
+		// url.Error chứa nguyên URL (kể cả password), chỉ giữ lại lỗi gốc
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
 		return nil, fmt.Errorf("unable to parse proxy URL: %w", err)
 	}
 	d, err := xproxy.FromURL(parsedURL, forward)
 	if err != nil {
-		return nil, fmt.Errorf("unable to construct proxy dialer from URL %q: %w", proxyURL, err)
+		return nil, fmt.Errorf("unable to construct proxy dialer from URL %q: %w", parsedURL.Redacted(), err)
 	}
 	return MaybeWrapWithHostnameWanter(MaybeWrapWithContextDialer(d)), nil
 }
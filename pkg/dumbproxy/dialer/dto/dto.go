@@ -3,6 +3,7 @@ package dto
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 )
 
 type boundDialerContextKey struct{}
@@ -52,3 +53,63 @@ func OrigDstFromContext(ctx context.Context) (string, bool) {
 func OrigDstToContext(ctx context.Context, dst string) context.Context {
 	return context.WithValue(ctx, origDstKey{}, dst)
 }
+
+// RouteOverride forces AssetRoutingDialer's direct/upstream decision for one request
+type RouteOverride int
+
+const (
+	RouteAuto          RouteOverride = iota // classify with the static asset heuristic
+	RouteForceUpstream                      // always dial through the upstream proxy
+	RouteForceDirect                        // always dial directly
+)
+
+type routeOverrideKey struct{}
+
+func RouteOverrideFromContext(ctx context.Context) RouteOverride {
+	if o, ok := ctx.Value(routeOverrideKey{}).(RouteOverride); ok {
+		return o
+	}
+	return RouteAuto
+}
+
+func RouteOverrideToContext(ctx context.Context, o RouteOverride) context.Context {
+	return context.WithValue(ctx, routeOverrideKey{}, o)
+}
+
+// RouteRecord receives the direct/upstream decision AssetRoutingDialer makes
+// for a request, so the handler can report it (e.g. in an access log).
+// It is safe for concurrent use.
+type RouteRecord struct {
+	v atomic.Int32 // 0: no decision, 1: direct, 2: upstream
+}
+
+// Set records the routing decision.
+func (r *RouteRecord) Set(direct bool) {
+	if direct {
+		r.v.Store(1)
+	} else {
+		r.v.Store(2)
+	}
+}
+
+// Get returns the recorded decision, ok is false if no dial was routed yet.
+func (r *RouteRecord) Get() (direct, ok bool) {
+	switch r.v.Load() {
+	case 1:
+		return true, true
+	case 2:
+		return false, true
+	}
+	return false, false
+}
+
+type routeRecordKey struct{}
+
+func RouteRecordFromContext(ctx context.Context) *RouteRecord {
+	rec, _ := ctx.Value(routeRecordKey{}).(*RouteRecord)
+	return rec
+}
+
+func RouteRecordToContext(ctx context.Context, rec *RouteRecord) context.Context {
+	return context.WithValue(ctx, routeRecordKey{}, rec)
+}
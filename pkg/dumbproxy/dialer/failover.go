@@ -0,0 +1,43 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// FailoverDialer dials through a list of upstream dialers in order and moves
+// on to the next one when a dial fails. The first successful connection wins.
+type FailoverDialer struct {
+	dialers []Dialer
+}
+
+func NewFailoverDialer(dialers ...Dialer) *FailoverDialer {
+	return &FailoverDialer{dialers: dialers}
+}
+
+func (d *FailoverDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(d.dialers) == 0 {
+		return nil, errors.New("failover dialer: no upstream configured")
+	}
+	var errs []error
+	for i, next := range d.dialers {
+		conn, err := next.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		// Caller gave up: trying the remaining upstreams would fail the same way
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("upstream #%d: %w", i+1, err))
+	}
+	return nil, fmt.Errorf("all %d upstreams failed: %w", len(d.dialers), errors.Join(errs...))
+}
+
+func (d *FailoverDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+var _ Dialer = &FailoverDialer{}
@@ -0,0 +1,138 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Family restricts the address family of outgoing connections.
+type Family int
+
+const (
+	FamilyAuto Family = iota
+	FamilyIPv4
+	FamilyIPv6
+)
+
+func (f Family) String() string {
+	switch f {
+	case FamilyAuto:
+		return "auto"
+	case FamilyIPv4:
+		return "ipv4"
+	case FamilyIPv6:
+		return "ipv6"
+	default:
+		return fmt.Sprintf("Family(%d)", int(f))
+	}
+}
+
+func ParseFamily(s string) (Family, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto", "any":
+		return FamilyAuto, nil
+	case "ipv4", "ip4", "v4", "4":
+		return FamilyIPv4, nil
+	case "ipv6", "ip6", "v6", "6":
+		return FamilyIPv6, nil
+	}
+	return FamilyAuto, fmt.Errorf("unknown dial family %q (expected auto, ipv4 or ipv6)", s)
+}
+
+func (f Family) matches(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	switch f {
+	case FamilyIPv4:
+		return addr.Is4()
+	case FamilyIPv6:
+		return addr.Is6()
+	}
+	return true
+}
+
+// restrict maps a generic network ("tcp") to its family specific variant ("tcp4").
+func (f Family) restrict(network string) (string, error) {
+	suffix := "4"
+	if f == FamilyIPv6 {
+		suffix = "6"
+	}
+	switch network {
+	case "tcp", "udp", "ip":
+		return network + suffix, nil
+	case "tcp" + suffix, "udp" + suffix, "ip" + suffix:
+		return network, nil
+	}
+	return "", fmt.Errorf("network %q is not allowed with dial family %s", network, f)
+}
+
+// FamilyDialer forces every connection onto a single address family.
+// Hostnames are resolved for that family only, so a dual-stack name never
+// falls back to the other one.
+type FamilyDialer struct {
+	next   Dialer
+	family Family
+}
+
+// NewFamilyDialer wraps next so that all connections use the given family.
+// FamilyAuto returns next unchanged.
+func NewFamilyDialer(next Dialer, resolver Resolver, family Family) Dialer {
+	if family == FamilyAuto {
+		return next
+	}
+	return FamilyDialer{
+		next:   NewNameResolvingDialer(next, familyResolver{resolver: resolver, family: family}),
+		family: family,
+	}
+}
+
+func (fd FamilyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	restricted, err := fd.family.restrict(network)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract host and port from %s: %w", address, err)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !fd.family.matches(addr) {
+		return nil, fmt.Errorf("address %s does not match dial family %s", host, fd.family)
+	}
+	return fd.next.DialContext(ctx, restricted, address)
+}
+
+func (fd FamilyDialer) Dial(network, address string) (net.Conn, error) {
+	return fd.DialContext(context.Background(), network, address)
+}
+
+var _ Dialer = FamilyDialer{}
+
+// familyResolver drops addresses of the other family and reports a clear
+// error when nothing is left.
+type familyResolver struct {
+	resolver Resolver
+	family   Family
+}
+
+func (r familyResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	lookupNetwork := "ip4"
+	if r.family == FamilyIPv6 {
+		lookupNetwork = "ip6"
+	}
+	addrs, err := r.resolver.LookupNetIP(ctx, lookupNetwork, host)
+	if err != nil {
+		return nil, fmt.Errorf("no %s address found for %q: %w", r.family, host, err)
+	}
+	res := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if r.family.matches(addr) {
+			res = append(res, addr)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no %s address found for %q", r.family, host)
+	}
+	return res, nil
+}
@@ -107,7 +107,7 @@ func (d *BoundDialer) DialContext(ctx context.Context, network, address string)
 	if d.localAddr != "" {
 		switch network {
 		case "tcp", "tcp4", "tcp6":
-			addr, err := net.ResolveTCPAddr(network, d.localAddr+":0")
+			addr, err := net.ResolveTCPAddr(network, net.JoinHostPort(d.localAddr, "0"))
 			if err != nil {
 				return nil, fmt.Errorf("failed to resolve local address: %w", err)
 			}
@@ -118,7 +118,7 @@ func (d *BoundDialer) DialContext(ctx context.Context, network, address string)
 				KeepAlive: d.next.KeepAlive,
 			}
 		case "udp", "udp4", "udp6":
-			addr, err := net.ResolveUDPAddr(network, d.localAddr+":0")
+			addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(d.localAddr, "0"))
 			if err != nil {
 				return nil, fmt.Errorf("failed to resolve local address: %w", err)
 			}
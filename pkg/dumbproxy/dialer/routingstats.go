@@ -0,0 +1,56 @@
+package dialer
+
+import (
+	"net"
+	"sync"
+)
+
+// HostRouting holds the number of connections routed direct and via the
+// upstream proxy for a single host.
+type HostRouting struct {
+	Direct   int64
+	Upstream int64
+}
+
+// RoutingStats tallies AssetRoutingDialer decisions per destination host.
+// It is meant for debugging the static asset heuristics and is safe for
+// concurrent use.
+type RoutingStats struct {
+	mu    sync.Mutex
+	hosts map[string]*HostRouting
+}
+
+// NewRoutingStats creates an empty RoutingStats.
+func NewRoutingStats() *RoutingStats {
+	return &RoutingStats{hosts: make(map[string]*HostRouting)}
+}
+
+func (s *RoutingStats) record(address string, direct bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[host]
+	if !ok {
+		h = new(HostRouting)
+		s.hosts[host] = h
+	}
+	if direct {
+		h.Direct++
+	} else {
+		h.Upstream++
+	}
+}
+
+// Snapshot returns a copy of the tallies keyed by host.
+func (s *RoutingStats) Snapshot() map[string]HostRouting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]HostRouting, len(s.hosts))
+	for host, h := range s.hosts {
+		res[host] = *h
+	}
+	return res
+}
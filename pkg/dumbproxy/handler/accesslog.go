@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	ddto "github.com/tuwibu/goproxy/pkg/dumbproxy/dialer/dto"
+)
+
+// Routing decisions reported in AccessLogEntry.Route
+const (
+	RouteDirect   = "direct"
+	RouteUpstream = "upstream"
+)
+
+// AccessLogEntry describes one CONNECT tunnel or plain HTTP request served
+// by ProxyHandler.
+type AccessLogEntry struct {
+	Method string // CONNECT, GET, POST, ...
+	Host   string // destination host:port
+	// Route is RouteDirect or RouteUpstream as decided by AssetRoutingDialer,
+	// empty if no connection was dialed or the dialer does not report routing.
+	Route         string
+	Status        int   // status code sent to the client
+	BytesSent     int64 // bytes from the client to the destination
+	BytesReceived int64 // bytes from the destination to the client
+	Duration      time.Duration
+	Err           error // dial or fetch error, nil on success
+}
+
+// AccessLogFunc is called once per request after it completes. It is called
+// from connection goroutines and must be safe for concurrent use.
+type AccessLogFunc = func(AccessLogEntry)
+
+func (s *ProxyHandler) logAccess(req *http.Request, host string, start time.Time, status int, sent, received int64, err error) {
+	entry := AccessLogEntry{
+		Method:        req.Method,
+		Host:          host,
+		Status:        status,
+		BytesSent:     sent,
+		BytesReceived: received,
+		Duration:      time.Since(start),
+		Err:           err,
+	}
+	if rec := ddto.RouteRecordFromContext(req.Context()); rec != nil {
+		if direct, ok := rec.Get(); ok {
+			entry.Route = RouteUpstream
+			if direct {
+				entry.Route = RouteDirect
+			}
+		}
+	}
+	s.accessLog(entry)
+}
+
+// countingConn counts bytes written to (sent) and read from (received) the
+// outbound connection of a tunnel.
+type countingConn struct {
+	net.Conn
+	sent, received atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+// countingReader counts bytes read from a request or response body.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
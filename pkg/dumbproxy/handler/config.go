@@ -19,4 +19,11 @@ type Config struct {
 	Forward ForwardFunc
 	// UserIPHints specifies whether allow IP hints set by user or not
 	UserIPHints bool
+	// AccessLog optionally receives one entry per CONNECT tunnel or plain
+	// HTTP request with its destination, byte counts and routing decision.
+	AccessLog AccessLogFunc
+	// MaxConns limits the number of concurrent CONNECT tunnels and plain
+	// HTTP requests. Once reached, new ones are rejected with 503 Service
+	// Unavailable until an active one finishes. Zero means unlimited.
+	MaxConns int
 }
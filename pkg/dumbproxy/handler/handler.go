@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tuwibu/goproxy/pkg/dumbproxy/auth"
 	"github.com/tuwibu/goproxy/pkg/dumbproxy/dialer"
@@ -25,6 +26,14 @@ import (
 
 const HintsHeaderName = "X-Src-IP-Hints"
 
+// Request headers overriding the static asset routing of AssetRoutingDialer
+// for a single request ("1"/"true"). Both are stripped before forwarding;
+// force-upstream wins when both are set.
+const (
+	ForceUpstreamHeaderName = "X-Goproxy-Force-Upstream"
+	ForceDirectHeaderName   = "X-Goproxy-Force-Direct"
+)
+
 type HandlerDialer interface {
 	DialContext(ctx context.Context, net, address string) (net.Conn, error)
 }
@@ -40,6 +49,9 @@ type ProxyHandler struct {
 	outbound      map[string]string
 	outboundMux   sync.RWMutex
 	userIPHints   bool
+	accessLog     AccessLogFunc
+	// connSlots is a semaphore of Config.MaxConns slots, nil when unlimited
+	connSlots chan struct{}
 }
 
 func NewProxyHandler(config *Config) *ProxyHandler {
@@ -63,6 +75,10 @@ func NewProxyHandler(config *Config) *ProxyHandler {
 	if f == nil {
 		f = forward.PairConnections
 	}
+	var connSlots chan struct{}
+	if config.MaxConns > 0 {
+		connSlots = make(chan struct{}, config.MaxConns)
+	}
 	return &ProxyHandler{
 		auth:          a,
 		logger:        l,
@@ -71,22 +87,75 @@ func NewProxyHandler(config *Config) *ProxyHandler {
 		httptransport: httptransport,
 		outbound:      make(map[string]string),
 		userIPHints:   config.UserIPHints,
+		accessLog:     config.AccessLog,
+		connSlots:     connSlots,
+	}
+}
+
+// acquireConn takes a connection slot without waiting. It reports false when
+// MaxConns connections are already active; otherwise the caller must call
+// releaseConn once the tunnel or request is done.
+func (s *ProxyHandler) acquireConn() bool {
+	if s.connSlots == nil {
+		return true
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ProxyHandler) releaseConn() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// rejectBusy answers 503 when the connection limit is reached
+func (s *ProxyHandler) rejectBusy(wr http.ResponseWriter, req *http.Request, address string, start time.Time) {
+	s.logger.Warning("Too many concurrent connections, rejecting %s %s", req.Method, address)
+	http.Error(wr, "Too many concurrent connections", http.StatusServiceUnavailable)
+	if s.accessLog != nil {
+		s.logAccess(req, address, start, http.StatusServiceUnavailable, 0, 0, errTooManyConns)
 	}
 }
 
+// errTooManyConns is reported to AccessLog for requests rejected by MaxConns
+var errTooManyConns = errors.New("too many concurrent connections")
+
 func (s *ProxyHandler) HandleTunnel(wr http.ResponseWriter, req *http.Request, username string) {
+	start := time.Now()
+	if !s.acquireConn() {
+		s.rejectBusy(wr, req, req.RequestURI, start)
+		return
+	}
+	defer s.releaseConn()
 	conn, err := s.dialer.DialContext(req.Context(), "tcp", req.RequestURI)
 	if err != nil {
+		status := http.StatusBadGateway
 		var accessErr derrors.ErrAccessDenied
 		if errors.As(err, &accessErr) {
+			status = http.StatusForbidden
 			s.logger.Warning("Access denied: %v", err)
-			http.Error(wr, "Access denied", http.StatusForbidden)
-			return
+			http.Error(wr, "Access denied", status)
+		} else {
+			s.logger.Error("Can't satisfy CONNECT request: %v", err)
+			http.Error(wr, "Can't satisfy CONNECT request", status)
+		}
+		if s.accessLog != nil {
+			s.logAccess(req, req.RequestURI, start, status, 0, 0, err)
 		}
-		s.logger.Error("Can't satisfy CONNECT request: %v", err)
-		http.Error(wr, "Can't satisfy CONNECT request", http.StatusBadGateway)
 		return
 	}
+	if s.accessLog != nil {
+		counted := &countingConn{Conn: conn}
+		conn = counted
+		defer func() {
+			s.logAccess(req, req.RequestURI, start, http.StatusOK, counted.sent.Load(), counted.received.Load(), nil)
+		}()
+	}
 
 	localAddr := conn.LocalAddr().String()
 	s.outboundMux.Lock()
@@ -162,11 +231,27 @@ func addressFromURL(u *url.URL) string {
 }
 
 func (s *ProxyHandler) HandleRequest(wr http.ResponseWriter, req *http.Request, username string) {
+	start := time.Now()
+	address := addressFromURL(req.URL)
+	if !s.acquireConn() {
+		s.rejectBusy(wr, req, address, start)
+		return
+	}
+	defer s.releaseConn()
 	req.RequestURI = ""
 	forwardReqBody := newH1ReqBodyPipe()
 	origBody := req.Body
+	var reqBody *countingReader
+	if s.accessLog != nil {
+		reqBody = &countingReader{ReadCloser: origBody}
+		origBody = reqBody
+	}
 	req.Body = forwardReqBody.Body()
-	address := addressFromURL(req.URL)
+	logAccess := func(status int, received int64, err error) {
+		if s.accessLog != nil {
+			s.logAccess(req, address, start, status, reqBody.n.Load(), received, err)
+		}
+	}
 	go func() {
 		s.forward(req.Context(), username, wrapH1ReqBody(origBody), forwardReqBody, "tcp", address)
 	}()
@@ -180,10 +265,12 @@ func (s *ProxyHandler) HandleRequest(wr http.ResponseWriter, req *http.Request,
 		if errors.As(err, &accessErr) {
 			s.logger.Warning("Access denied: %v", err)
 			http.Error(wr, "Access denied", http.StatusForbidden)
+			logAccess(http.StatusForbidden, 0, err)
 			return
 		}
 		s.logger.Error("HTTP fetch error: %v", err)
 		http.Error(wr, "Server Error", http.StatusInternalServerError)
+		logAccess(http.StatusInternalServerError, 0, err)
 		return
 	}
 	defer resp.Body.Close()
@@ -192,7 +279,9 @@ func (s *ProxyHandler) HandleRequest(wr http.ResponseWriter, req *http.Request,
 	copyHeader(wr.Header(), resp.Header)
 	wr.WriteHeader(resp.StatusCode)
 	flush(wr)
-	s.forward(req.Context(), username, wrapH1RespWriter(wr), wrapH1ReqBody(resp.Body), "tcp", address)
+	respBody := &countingReader{ReadCloser: resp.Body}
+	s.forward(req.Context(), username, wrapH1RespWriter(wr), wrapH1ReqBody(respBody), "tcp", address)
+	logAccess(resp.StatusCode, respBody.n.Load(), nil)
 }
 
 func (s *ProxyHandler) HandleGetRandom(wr http.ResponseWriter, req *http.Request, username string) {
@@ -254,6 +343,14 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	}
 	ctx = ddto.BoundDialerParamsToContext(ctx, ipHints, trimAddrPort(localAddr))
 	ctx = ddto.FilterParamsToContext(ctx, req, username)
+	if s.accessLog != nil {
+		ctx = ddto.RouteRecordToContext(ctx, &ddto.RouteRecord{})
+	}
+	if override := routeOverride(req.Header); override != ddto.RouteAuto {
+		ctx = ddto.RouteOverrideToContext(ctx, override)
+	}
+	req.Header.Del(ForceUpstreamHeaderName)
+	req.Header.Del(ForceDirectHeaderName)
 	req = req.WithContext(ctx)
 	delHopHeaders(req.Header)
 	switch req.Method {
@@ -266,6 +363,20 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func routeOverride(header http.Header) ddto.RouteOverride {
+	enabled := func(name string) bool {
+		v, err := strconv.ParseBool(strings.TrimSpace(header.Get(name)))
+		return err == nil && v
+	}
+	switch {
+	case enabled(ForceUpstreamHeaderName):
+		return ddto.RouteForceUpstream
+	case enabled(ForceDirectHeaderName):
+		return ddto.RouteForceDirect
+	}
+	return ddto.RouteAuto
+}
+
 func trimAddrPort(addrPort string) string {
 	res, _, err := net.SplitHostPort(addrPort)
 	if err != nil {
@@ -188,6 +188,9 @@ func TLSConfigFromURL(u *url.URL) (*tls.Config, error) {
 		tlsConfig.InsecureSkipVerify = true
 		tlsConfig.VerifyConnection = ExpectPeerName(params.Get("peername"), tlsConfig.RootCAs)
 	}
+	if params.Has("insecure") {
+		tlsConfig.InsecureSkipVerify = true
+	}
 	if params.Has("cert") {
 		cert, err := tls.LoadX509KeyPair(params.Get("cert"), params.Get("key"))
 		if err != nil {
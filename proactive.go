@@ -0,0 +1,92 @@
+package goproxy
+
+import "time"
+
+// stagedRotation proxy mới được chuẩn bị sẵn cho 1 proxy đang sử dụng (ProactiveRotation)
+type stagedRotation struct {
+	done     chan struct{} // đóng khi đã gọi provider xong
+	proxyStr string
+	meta     providerMeta
+	err      error
+}
+
+// isProviderType kiểm tra loại proxy lấy IP qua API của provider (đã đăng ký bằng RegisterProvider)
+func isProviderType(t ProxyType) bool {
+	_, ok := getProvider(t)
+	return ok
+}
+
+// maybeStageRotation chuẩn bị sẵn IP tiếp theo cho proxy vừa được lấy (chạy nền)
+// Chỉ áp dụng khi bật ProactiveRotation và api key hỗ trợ nhiều session song song (cờ "parallel"),
+// provider cooldown đã qua và proxy chưa có IP chuẩn bị sẵn
+func (pm *ProxyManager) maybeStageRotation(id int64) {
+	if !pm.proactiveRotation {
+		return
+	}
+
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil || !isProviderType(p.Type) || !p.ParallelSessions || p.NextChangeAt.After(time.Now()) {
+		return
+	}
+	if pm.rotationLimited(p, time.Now()) {
+		return
+	}
+
+	pm.stagedMu.Lock()
+	if _, ok := pm.staged[id]; ok {
+		pm.stagedMu.Unlock()
+		return
+	}
+	sr := &stagedRotation{done: make(chan struct{})}
+	pm.staged[id] = sr
+	pm.stagedMu.Unlock()
+
+	go func() {
+		sr.proxyStr, sr.meta, sr.err = pm.fetchNewProxy(pm.baseContext(), p)
+		if sr.err != nil {
+			pm.logf("[ProxyManager] Proxy %d: failed to stage rotation: %v\n", id, sr.err)
+		}
+		close(sr.done)
+	}()
+}
+
+// takeStagedRotation lấy IP đã chuẩn bị sẵn cho proxy (nếu đã chuẩn bị xong và thành công)
+// IP chuẩn bị thất bại bị bỏ để lần sau chuẩn bị lại
+func (pm *ProxyManager) takeStagedRotation(id int64) (proxyStr string, meta providerMeta, ok bool) {
+	pm.stagedMu.Lock()
+	defer pm.stagedMu.Unlock()
+
+	sr, exists := pm.staged[id]
+	if !exists {
+		return "", meta, false
+	}
+	select {
+	case <-sr.done:
+	default:
+		// Đang chuẩn bị: rotate bình thường, giữ lại để lần sau dùng
+		return "", meta, false
+	}
+	delete(pm.staged, id)
+	if sr.err != nil {
+		return "", meta, false
+	}
+	return sr.proxyStr, sr.meta, true
+}
+
+// HasStagedRotation cho biết proxy đã có IP tiếp theo được chuẩn bị sẵn (ProactiveRotation)
+func (pm *ProxyManager) HasStagedRotation(id int64) bool {
+	pm.stagedMu.Lock()
+	sr, exists := pm.staged[id]
+	pm.stagedMu.Unlock()
+	if !exists {
+		return false
+	}
+	select {
+	case <-sr.done:
+		return sr.err == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,357 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tuwibu/goproxy/service"
+)
+
+// Provider API cấp proxy theo api key (tmproxy, kiotproxy, ipv4xoay, ...)
+// Đăng ký bằng RegisterProvider, ProxyManager tự xử lý load/rotate/lỗi cho mọi provider
+type Provider interface {
+	// GetNew lấy IP mới cho api key
+	GetNew(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error)
+	// GetCurrent lấy proxy hiện tại của api key khi load (không đổi IP)
+	// Trả về lỗi bọc ErrNoCurrentProxy nếu nên lấy IP mới (chưa có proxy, hết hạn, đã đủ điều kiện đổi IP)
+	GetCurrent(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error)
+	// ParseConfig đọc tuỳ chọn riêng của provider từ các phần sau api key của dòng proxy
+	// Trả về các phần còn lại (min_time, change_url/region) để xử lý chung
+	ParseConfig(parts []string) (opts ProviderOptions, rest []string, err error)
+}
+
+// ProviderOptions tuỳ chọn của 1 proxy khi gọi API provider
+type ProviderOptions struct {
+	IDLocation int    // tmproxy: id_location
+	IDISP      int    // tmproxy: id_isp
+	Region     string // kiotproxy: region (lưu ở change_url)
+	NhaMang    string // ipv4xoay: nhà mạng (tuỳ chọn "nhamang=NAME", "" = random)
+	TinhThanh  string // ipv4xoay: tỉnh thành (tuỳ chọn "tinhthanh=N", "" = 0 ngẫu nhiên)
+	SOCKS5     bool   // dùng proxy SOCKS5 của provider thay cho HTTP (cờ "socks5")
+}
+
+// ProxyResult proxy do provider trả về
+// Provider cấp cả HTTP và SOCKS5 cho cùng IP thì điền cả HTTPAddr và SOCKS5Addr: cả 2 được lưu vào db
+// (cột http_str/socks5_str) để phục vụ theo giao thức khi cần (GetAvailableProxySOCKS5) mà không gọi lại API
+type ProxyResult struct {
+	HTTPAddr   string // host:port của proxy HTTP, "" nếu provider không cấp HTTP
+	SOCKS5Addr string // host:port của proxy SOCKS5, "" nếu provider không cấp SOCKS5
+	Username   string // user/pass dùng chung cho HTTP và SOCKS5, rỗng nếu xác thực theo IP
+	Password   string
+	// ProxyStr proxy HTTP dạng host:port:user:pass, để trống thì được tạo từ HTTPAddr/Username/Password
+	ProxyStr  string
+	IP        string // IP public (exit IP)
+	Location  string
+	ISP       string
+	ExpiresAt time.Time
+	// NextChangeAt thời điểm sớm nhất provider cho phép đổi IP, zero nếu đổi được ngay
+	NextChangeAt time.Time
+	// IPAllow whitelist IP của api key (tmproxy), rỗng nếu provider không hỗ trợ
+	IPAllow string
+	// IPExpiresAt thời điểm IP hiện tại hết hạn, zero nếu không rõ. IP sắp hết hạn được đổi sớm (bỏ qua min_time)
+	IPExpiresAt time.Time
+	// SOCKS5Str proxy SOCKS5 cùng IP dạng socks5://host:port:user:pass (xem socks5ProxyStr), để trống thì được
+	// tạo từ SOCKS5Addr/Username/Password. Dùng thay cho proxy HTTP khi dòng proxy có cờ "socks5"
+	SOCKS5Str string
+}
+
+func (r ProxyResult) meta() providerMeta {
+	return providerMeta{IP: r.IP, Location: r.Location, ISP: r.ISP, ExpiresAt: r.ExpiresAt, NextChangeAt: r.NextChangeAt, IPExpiresAt: r.IPExpiresAt,
+		HTTPStr: r.httpStr(), SOCKS5Str: r.socks5Str()}
+}
+
+// httpStr proxy string HTTP "host:port:user:pass" ("host:port" nếu không có user/pass), "" nếu provider không cấp HTTP
+func (r ProxyResult) httpStr() string {
+	if r.ProxyStr != "" || r.HTTPAddr == "" {
+		return r.ProxyStr
+	}
+	if r.Username == "" && r.Password == "" {
+		return r.HTTPAddr
+	}
+	return fmt.Sprintf("%s:%s:%s", r.HTTPAddr, r.Username, r.Password)
+}
+
+// socks5Str proxy string SOCKS5 "socks5://host:port:user:pass", "" nếu provider không cấp SOCKS5
+func (r ProxyResult) socks5Str() string {
+	if r.SOCKS5Str != "" {
+		return r.SOCKS5Str
+	}
+	return socks5ProxyStr(r.SOCKS5Addr, r.Username, r.Password)
+}
+
+// connectionString proxy_str lưu vào db: proxy SOCKS5 nếu socks5 (cờ "socks5"), ngược lại proxy HTTP
+func (r ProxyResult) connectionString(socks5 bool) (string, error) {
+	if !socks5 {
+		return r.httpStr(), nil
+	}
+	proxyStr := r.socks5Str()
+	if proxyStr == "" {
+		return "", errors.New("provider did not return a SOCKS5 proxy")
+	}
+	return proxyStr, nil
+}
+
+// socks5ProxyStr tạo proxy string SOCKS5 "socks5://host:port:user:pass" từ địa chỉ và user/pass của provider
+// Không có user/pass (xác thực theo IP): "socks5://host:port". hostPort rỗng: trả về ""
+func socks5ProxyStr(hostPort, username, password string) string {
+	if hostPort == "" {
+		return ""
+	}
+	if username == "" && password == "" {
+		return "socks5://" + hostPort
+	}
+	return fmt.Sprintf("socks5://%s:%s:%s", hostPort, username, password)
+}
+
+var (
+	// ErrNoCurrentProxy GetCurrent báo cần lấy IP mới (GetNew)
+	ErrNoCurrentProxy = errors.New("no current proxy")
+	// ErrProviderBlocking provider tạm thời từ chối cấp proxy (vd: ipv4xoay status 101)
+	// Proxy không bị đánh dấu lỗi, sẽ thử lại ở lần lấy sau
+	ErrProviderBlocking = errors.New("provider api is blocking")
+)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[ProxyType]Provider{
+		ProxyTypeTMProxy:   tmproxyProvider{},
+		ProxyTypeKiotProxy: kiotproxyProvider{},
+		ProxyTypeIPv4Xoay:  ipv4xoayProvider{},
+	}
+)
+
+// RegisterProvider đăng ký provider cho loại proxy t (ghi đè nếu đã có)
+// Dòng proxy dạng "t|api_key|min_time|..." sẽ được load và rotate qua provider
+func RegisterProvider(t ProxyType, p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[t] = p
+}
+
+// getProvider trả về provider của loại proxy t
+func getProvider(t ProxyType) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	p, ok := providers[t]
+	return p, ok
+}
+
+// providerTypes các loại proxy đã đăng ký provider, sắp xếp theo tên
+func providerTypes() []ProxyType {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	types := make([]ProxyType, 0, len(providers))
+	for t := range providers {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// providerOptionsFor dựng ProviderOptions từ các cột đã lưu của proxy
+func providerOptionsFor(p *Proxy) ProviderOptions {
+	return ProviderOptions{IDLocation: p.IDLocation, IDISP: p.IDISP, Region: p.ChangeUrl, NhaMang: p.NhaMang, TinhThanh: p.TinhThanh, SOCKS5: p.SOCKS5}
+}
+
+// tmproxyProvider https://tmproxy.com
+type tmproxyProvider struct{}
+
+func (tmproxyProvider) GetNew(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error) {
+	resp, err := service.GetTMProxy().GetNewProxyContext(ctx, apiKey, opts.IDLocation, opts.IDISP)
+	if err != nil {
+		return ProxyResult{}, fmt.Errorf("GetNewProxy failed: %v", err)
+	}
+	if resp.Code != 0 {
+		return ProxyResult{}, fmt.Errorf("tmproxy api returned code: %d, message: %s", resp.Code, resp.Message)
+	}
+	return tmproxyResult(resp.Data, resp.ServerTime), nil
+}
+
+func (tmproxyProvider) GetCurrent(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error) {
+	resp, err := service.GetTMProxy().GetCurrentProxyContext(ctx, apiKey)
+	if err != nil {
+		return ProxyResult{}, fmt.Errorf("%w: %v", ErrNoCurrentProxy, err)
+	}
+	if resp.Code != 0 {
+		return ProxyResult{}, fmt.Errorf("%w: code: %d, message: %s", ErrNoCurrentProxy, resp.Code, resp.Message)
+	}
+	// Timeout == 0 (hết hạn) hoặc NextRequest == 0 (đủ điều kiện thay IP) → lấy IP mới
+	if resp.Data.Timeout == 0 || resp.Data.NextRequest == 0 {
+		return ProxyResult{}, ErrNoCurrentProxy
+	}
+	return tmproxyResult(resp.Data, resp.ServerTime), nil
+}
+
+// ParseConfig đọc "location=N", "isp=N" (id_location/id_isp khi GetNewProxy)
+func (tmproxyProvider) ParseConfig(parts []string) (opts ProviderOptions, rest []string, err error) {
+	for _, part := range parts {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || (name != "location" && name != "isp") {
+			rest = append(rest, part)
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return opts, nil, fmt.Errorf("invalid %s: %s", name, part)
+		}
+		if name == "location" {
+			opts.IDLocation = n
+		} else {
+			opts.IDISP = n
+		}
+	}
+	return opts, rest, nil
+}
+
+func tmproxyResult(data service.TMProxyData, serverTime time.Time) ProxyResult {
+	meta := tmproxyMeta(data, serverTime)
+	return ProxyResult{
+		HTTPAddr:     data.HTTPS,
+		SOCKS5Addr:   data.SOCKS5,
+		Username:     data.Username,
+		Password:     data.Password,
+		IP:           meta.IP,
+		Location:     meta.Location,
+		ISP:          meta.ISP,
+		ExpiresAt:    meta.ExpiresAt,
+		NextChangeAt: meta.NextChangeAt,
+		IPAllow:      data.IPAllow,
+	}
+}
+
+// kiotproxyProvider https://kiotproxy.com
+type kiotproxyProvider struct{}
+
+func (kiotproxyProvider) GetNew(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error) {
+	resp, err := service.GetKiotProxy().GetNewProxyContext(ctx, apiKey, opts.Region)
+	if err != nil {
+		return ProxyResult{}, fmt.Errorf("GetNewProxy failed: %v", err)
+	}
+	if !resp.Success {
+		return ProxyResult{}, fmt.Errorf("kiotproxy api returned code: %d, message: %s, error: %s", resp.Code, resp.Message, resp.Error)
+	}
+	return kiotproxyResult(resp.Data), nil
+}
+
+func (kiotproxyProvider) GetCurrent(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error) {
+	resp, err := service.GetKiotProxy().GetCurrentProxyContext(ctx, apiKey)
+	if err != nil {
+		return ProxyResult{}, fmt.Errorf("%w: %v", ErrNoCurrentProxy, err)
+	}
+	// Đã đủ điều kiện thay IP (ttc/nextRequestAt đã qua) hoặc IP sắp hết ttl → lấy IP mới
+	res := kiotproxyResult(resp.Data)
+	now := time.Now()
+	if !res.NextChangeAt.After(now) || ipExpiringSoon(res.IPExpiresAt, now) {
+		return ProxyResult{}, ErrNoCurrentProxy
+	}
+	return res, nil
+}
+
+// ParseConfig đọc "region=NAME". Region cũng có thể truyền theo vị trí (change_url), vd: kiotproxy|key|130|hanoi
+func (kiotproxyProvider) ParseConfig(parts []string) (opts ProviderOptions, rest []string, err error) {
+	for _, part := range parts {
+		if value, ok := strings.CutPrefix(part, "region="); ok {
+			opts.Region = strings.TrimSpace(value)
+			continue
+		}
+		rest = append(rest, part)
+	}
+	return opts, rest, nil
+}
+
+func kiotproxyResult(data service.KiotProxyData) ProxyResult {
+	meta := kiotproxyMeta(data)
+	// KiotProxy xác thực theo IP: socks5 là "host:port", không có user/pass
+	socks5 := data.SOCKS5
+	if socks5 == "" && data.Host != "" && data.SOCKS5Port > 0 {
+		socks5 = net.JoinHostPort(data.Host, strconv.Itoa(data.SOCKS5Port))
+	}
+	return ProxyResult{
+		HTTPAddr:     data.HTTP,
+		SOCKS5Addr:   socks5,
+		IP:           meta.IP,
+		Location:     meta.Location,
+		ExpiresAt:    meta.ExpiresAt,
+		NextChangeAt: meta.NextChangeAt,
+		IPExpiresAt:  meta.IPExpiresAt,
+	}
+}
+
+// ipv4xoayProvider https://proxyxoay.shop, dùng chung 1 API cho lấy proxy hiện tại và IP mới
+type ipv4xoayProvider struct{}
+
+func (ipv4xoayProvider) GetNew(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error) {
+	resp, err := service.GetIPv4Xoay().GetNewProxyContext(ctx, apiKey, opts.NhaMang, opts.TinhThanh)
+	if err != nil {
+		return ProxyResult{}, fmt.Errorf("GetNewProxy failed: %v", err)
+	}
+	if resp == nil {
+		return ProxyResult{}, fmt.Errorf("ipv4xoay api is blocking (status 101), will retry later: %w", ErrProviderBlocking)
+	}
+	return ipv4xoayResult(resp), nil
+}
+
+func (ipv4xoayProvider) GetCurrent(ctx context.Context, apiKey string, opts ProviderOptions) (ProxyResult, error) {
+	resp, err := service.GetIPv4Xoay().GetCurrentProxyContext(ctx, apiKey, opts.NhaMang, opts.TinhThanh)
+	if err != nil {
+		return ProxyResult{}, fmt.Errorf("GetCurrentProxy failed: %v", err)
+	}
+	if resp == nil {
+		return ProxyResult{}, fmt.Errorf("ipv4xoay api is blocking (status 101), will retry later: %w", ErrProviderBlocking)
+	}
+	return ipv4xoayResult(resp), nil
+}
+
+// ParseConfig đọc "nhamang=NAME", "tinhthanh=N" (nhà mạng/tỉnh thành khi lấy proxy),
+// vd: ipv4xoay|api_key|60|nhamang=viettel|tinhthanh=1
+func (ipv4xoayProvider) ParseConfig(parts []string) (opts ProviderOptions, rest []string, err error) {
+	for _, part := range parts {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || (name != "nhamang" && name != "tinhthanh") {
+			rest = append(rest, part)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "" || strings.ContainsAny(value, "&?#= ") {
+			return opts, nil, fmt.Errorf("invalid %s: %s", name, part)
+		}
+		if name == "nhamang" {
+			opts.NhaMang = value
+		} else {
+			opts.TinhThanh = value
+		}
+	}
+	return opts, rest, nil
+}
+
+func ipv4xoayResult(resp *service.IPv4XoayResponse) ProxyResult {
+	meta := ipv4xoayMeta(resp)
+	// proxyhttp/proxysocks5 dạng "host:port:user:pass" (user/pass có thể rỗng), dùng chung user/pass
+	res := ProxyResult{
+		IP:        meta.IP,
+		Location:  meta.Location,
+		ISP:       meta.ISP,
+		ExpiresAt: meta.ExpiresAt,
+	}
+	if parts := strings.SplitN(resp.ProxyHTTP, ":", 4); len(parts) == 4 {
+		res.HTTPAddr, res.Username, res.Password = parts[0]+":"+parts[1], parts[2], parts[3]
+	} else {
+		res.HTTPAddr = resp.ProxyHTTP
+	}
+	if parts := strings.SplitN(resp.ProxySOCKS5, ":", 4); len(parts) == 4 {
+		res.SOCKS5Addr = parts[0] + ":" + parts[1]
+		if res.Username == "" && res.Password == "" {
+			res.Username, res.Password = parts[2], parts[3]
+		}
+	} else {
+		res.SOCKS5Addr = resp.ProxySOCKS5
+	}
+	return res
+}
@@ -0,0 +1,91 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// proxyFileWatchInterval chu kỳ kiểm tra mtime của ProxyFile khi bật WatchProxyFile
+var proxyFileWatchInterval = 2 * time.Second
+
+// readProxyFile đọc danh sách proxy từ file, tách dòng/dấu phẩy và bỏ comment như LoadProxiesFromString
+func readProxyFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy file: %w", err)
+	}
+	entries := splitProxyBlob(string(data))
+	proxyStrings := make([]string, len(entries))
+	for i, entry := range entries {
+		proxyStrings[i] = entry.input
+	}
+	return proxyStrings, nil
+}
+
+// configProxyStrings ProxyStrings của config ghép với các dòng của ProxyFile (nếu có)
+func configProxyStrings(config Config) ([]string, error) {
+	if config.ProxyFile == "" {
+		return config.ProxyStrings, nil
+	}
+	fromFile, err := readProxyFile(config.ProxyFile)
+	if err != nil {
+		return nil, err
+	}
+	proxyStrings := make([]string, 0, len(config.ProxyStrings)+len(fromFile))
+	proxyStrings = append(proxyStrings, config.ProxyStrings...)
+	return append(proxyStrings, fromFile...), nil
+}
+
+// watchProxyFileLocked dừng theo dõi ProxyFile cũ và bắt đầu theo dõi theo config (nếu bật WatchProxyFile)
+// Khi mtime/kích thước file thay đổi thì gọi ReloadConfig với config này. Caller phải giữ pm.mu
+func (pm *ProxyManager) watchProxyFileLocked(config Config) {
+	if pm.watchCancel != nil {
+		pm.watchCancel()
+		pm.watchCancel = nil
+	}
+	if !config.WatchProxyFile || config.ProxyFile == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pm.watchCancel = cancel
+
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(config.ProxyFile); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	go func() {
+		ticker := time.NewTicker(proxyFileWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(config.ProxyFile)
+			if err != nil || (info.ModTime().Equal(lastMod) && info.Size() == lastSize) {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+
+			pm.mu.Lock()
+			// SetConfig/ReloadConfig khác đã thay config trong lúc đợi lock
+			if ctx.Err() != nil {
+				pm.mu.Unlock()
+				return
+			}
+			if err := pm.reloadConfigLocked(config); err != nil {
+				pm.logf("[ProxyManager] Failed to reload proxy file %s: %v\n", config.ProxyFile, err)
+			} else {
+				pm.logf("[ProxyManager] Reloaded proxy file %s\n", config.ProxyFile)
+			}
+			pm.mu.Unlock()
+		}
+	}()
+}
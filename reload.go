@@ -0,0 +1,182 @@
+package goproxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// ReloadConfig áp dụng config mới mà không xoá pool: so sánh ProxyStrings với pool hiện tại theo unique_key
+//   - dòng chưa có trong pool được load như LoadProxiesFromList (gọi API provider nếu cần)
+//   - proxy không còn trong ProxyStrings bị xoá (kể cả đang được giữ), instance của nó bị dừng
+//   - proxy vẫn còn được giữ nguyên (used/last_changed/running/instance), kể cả khi tuỳ chọn
+//     của dòng (min_time, tag=, weight=, ...) thay đổi; dùng SetConfig để load lại toàn bộ
+//
+// Các tuỳ chọn khác của config được áp dụng như SetConfig, ClearAllProxy bị bỏ qua.
+// Dùng cho service chạy lâu cần cập nhật danh sách proxy mà không làm gián đoạn pool
+func (pm *ProxyManager) ReloadConfig(config Config) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if err := pm.reloadConfigLocked(config); err != nil {
+		return err
+	}
+	pm.watchProxyFileLocked(config)
+	return nil
+}
+
+// reloadConfigLocked giống ReloadConfig nhưng caller phải giữ pm.mu, không đổi WatchProxyFile
+func (pm *ProxyManager) reloadConfigLocked(config Config) error {
+	proxyStrings, err := configProxyStrings(config)
+	if err != nil {
+		return err
+	}
+	config.ProxyStrings = proxyStrings
+	if err := pm.applyConfigLocked(config); err != nil {
+		return err
+	}
+
+	rows, err := pm.db.Query(`SELECT id, unique_key FROM proxies`)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var uniqueKey string
+		if err := rows.Scan(&id, &uniqueKey); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[uniqueKey] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Dòng sai format/loại proxy vẫn đưa vào LoadProxiesFromList để báo lỗi như SetConfig
+	keep := make(map[int64]bool)
+	var added []string
+	for _, s := range config.ProxyStrings {
+		parts := strings.Split(strings.TrimSpace(s), "|")
+		if len(parts) >= 2 && pm.validateProxyType(ProxyType(parts[0])) == nil {
+			key, err := expandAPIKey(parts[1])
+			if id, ok := existing[proxyUniqueKey(ProxyType(parts[0]), key)]; err == nil && ok {
+				keep[id] = true
+				continue
+			}
+		}
+		added = append(added, s)
+	}
+
+	var removed []int64
+	for _, id := range existing {
+		if !keep[id] {
+			removed = append(removed, id)
+		}
+	}
+	for _, id := range removed {
+		pm.removeProxyLocked(id)
+	}
+
+	ids, _, lineErrs := pm.LoadProxiesFromList(added)
+	for _, lineErr := range lineErrs {
+		pm.logf("[ProxyManager] Warning: skipped proxy %s (input: %s)\n", lineErr, pm.displayProxyLine(lineErr.Input))
+	}
+	addedCount := len(ids)
+
+	// Bật/tắt IsBlockAssets: dừng hoặc khởi động instance cho cả pool, ngược lại chỉ cho proxy mới
+	GetDumbProxyManager().SetLimits(config.MaxInstances, config.InstanceIdleTTL)
+	if pm.isBlockAssets != config.IsBlockAssets {
+		GetDumbProxyManager().StopAll()
+		if config.IsBlockAssets {
+			kept := make([]int64, 0, len(keep))
+			for id := range keep {
+				kept = append(kept, id)
+			}
+			sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+			ids = append(kept, ids...)
+		}
+	}
+	pm.isBlockAssets = config.IsBlockAssets
+	if config.IsBlockAssets {
+		pm.startInstancesLocked(ids, config.MaxInstances)
+	}
+
+	pm.nonUniqueMaxUsed = config.NonUniqueMaxUsed
+	pm.maxUsed = config.MaxUsed
+
+	pm.logf("[ProxyManager] Reloaded config: %d added, %d removed, %d unchanged\n", addedCount, len(removed), len(keep))
+	return nil
+}
+
+// SetMaxUsed đổi MaxUsed khi đang chạy, áp dụng từ lần GetAvailableProxy tiếp theo
+// Khác SetConfig/ReloadConfig: không reset used, không load lại proxy, không restart instance
+func (pm *ProxyManager) SetMaxUsed(n int) {
+	pm.mu.Lock()
+	raised := n > pm.maxUsed
+	pm.maxUsed = n
+	pm.mu.Unlock()
+
+	pm.logf("[ProxyManager] MaxUsed set to %d\n", n)
+	// Tăng MaxUsed có thể làm proxy đã dùng hết lượt dùng được tiếp: đánh thức GetAvailableProxyWait
+	if raised {
+		pm.notifyRelease()
+	}
+}
+
+// evictOverflowLocked xoá bớt proxy để pool không vượt quá MaxPoolSize, caller phải giữ pm.mu
+// Không xoá proxy đang được giữ (running) và proxy trong keep (vừa được load). Thứ tự xoá: used cao nhất trước
+// (proxy đã dùng gần hết), cùng used thì proxy lâu không được cập nhật nhất trước. Trả về id các proxy bị xoá
+func (pm *ProxyManager) evictOverflowLocked(keep []int64) []int64 {
+	var total int
+	if err := pm.db.QueryRow(`SELECT COUNT(*) FROM proxies`).Scan(&total); err != nil || total <= pm.maxPoolSize {
+		return nil
+	}
+	excess := total - pm.maxPoolSize
+
+	kept := make(map[int64]bool, len(keep))
+	for _, id := range keep {
+		kept[id] = true
+	}
+	rows, err := pm.db.Query(`SELECT id FROM proxies WHERE running=0 ORDER BY used DESC, updated_at ASC, id ASC`)
+	if err != nil {
+		return nil
+	}
+	var evicted []int64
+	for rows.Next() && len(evicted) < excess {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			break
+		}
+		if !kept[id] {
+			evicted = append(evicted, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range evicted {
+		pm.removeProxyLocked(id)
+	}
+	if len(evicted) > 0 {
+		pm.logf("[ProxyManager] Evicted %d proxies to keep pool within MaxPoolSize=%d\n", len(evicted), pm.maxPoolSize)
+	}
+	if len(evicted) < excess {
+		pm.logf("[ProxyManager] Warning: pool has %d proxies, exceeds MaxPoolSize=%d (remaining proxies are in use or just loaded)\n", total-len(evicted), pm.maxPoolSize)
+	}
+	return evicted
+}
+
+// removeProxyLocked xoá proxy khỏi db/cache và dừng instance của nó, caller phải giữ pm.mu
+func (pm *ProxyManager) removeProxyLocked(id int64) {
+	pm.db.Exec(`DELETE FROM proxies WHERE id=?`, id)
+	pm.db.Exec(`DELETE FROM proxy_usage WHERE proxy_id=?`, id)
+	delete(pm.proxyCache, id)
+	delete(pm.stickySessions, id)
+	delete(pm.health, id)
+	GetDumbProxyManager().StopInstance(id)
+
+	pm.stagedMu.Lock()
+	delete(pm.staged, id)
+	pm.stagedMu.Unlock()
+	pm.logf("[ProxyManager] Removed proxy %d\n", id)
+}
@@ -0,0 +1,118 @@
+package goproxy
+
+import (
+	"errors"
+	"time"
+)
+
+// rotationWindow cửa sổ trượt của Config.MaxRotationsPerHour
+const rotationWindow = time.Hour
+
+// ErrRotationLimit api key đã đổi IP đủ MaxRotationsPerHour lần trong 1 giờ gần nhất
+var ErrRotationLimit = errors.New("rotation limit reached")
+
+// recordRotation ghi 1 lần đổi IP qua provider của api key vào bảng proxy_rotations
+// Theo unique_key (api key) thay vì proxy id để cửa sổ không bị reset khi restart/ClearAllProxy
+func (pm *ProxyManager) recordRotation(p *Proxy, now time.Time) {
+	key := proxyUniqueKey(p.Type, p.ApiKey)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.db.Exec(`INSERT INTO proxy_rotations (unique_key, rotated_at) VALUES (?, ?)`, key, now.Unix())
+	pm.db.Exec(`DELETE FROM proxy_rotations WHERE unique_key=? AND rotated_at<=?`, key, now.Add(-rotationWindow).Unix())
+}
+
+// rotationCount số lần đổi IP qua provider của api key của proxy trong rotationWindow tính tới now
+func (pm *ProxyManager) rotationCount(p *Proxy, now time.Time) int {
+	var count int
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	pm.db.QueryRow(`SELECT COUNT(*) FROM proxy_rotations WHERE unique_key=? AND rotated_at>?`,
+		proxyUniqueKey(p.Type, p.ApiKey), now.Add(-rotationWindow).Unix()).Scan(&count)
+	return count
+}
+
+// rotationLimited api key của proxy đã đổi IP đủ MaxRotationsPerHour lần (luôn false nếu không giới hạn)
+func (pm *ProxyManager) rotationLimited(p *Proxy, now time.Time) bool {
+	if pm.maxRotationsPerHour <= 0 || !isProviderType(p.Type) {
+		return false
+	}
+	return pm.rotationCount(p, now) >= pm.maxRotationsPerHour
+}
+
+// RotationCount trả về số lần proxy (api key của nó) đã đổi IP qua provider trong 1 giờ gần nhất
+func (pm *ProxyManager) RotationCount(id int64) (int, error) {
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if !isProviderType(p.Type) {
+		return 0, nil
+	}
+	return pm.rotationCount(p, time.Now()), nil
+}
+
+// RotationNever NextRotationTime của proxy không bao giờ đổi IP (static, auto)
+var RotationNever = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+
+// NextRotationTime thời điểm sớm nhất proxy được đổi IP ở lần cấp phát tiếp theo, giúp caller canh đợt request
+// theo chu kỳ đổi IP. Tính như GetAvailableProxy: last_changed + min_time (kèm RotationJitter), sớm hơn nếu IP
+// sắp hết hạn (ip_expires_at), không sớm hơn cooldown của provider (next_change_at) và MaxRotationsPerHour.
+// Thời điểm đã qua nghĩa là đổi được ngay. mobilehop/sticky non-unique đổi IP (session) mỗi lần lấy: trả về now.
+// static/auto không đổi IP: trả về RotationNever
+func (pm *ProxyManager) NextRotationTime(id int64) (time.Time, error) {
+	pm.mu.RLock()
+	p, err := pm.getProxyByID(id)
+	pm.mu.RUnlock()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	switch {
+	case p.Type == ProxyTypeStatic || p.Type == ProxyTypeAuto:
+		return RotationNever, nil
+	case p.Type == ProxyTypeMobileHop || !p.Unique || p.FreshSessionEachUse:
+		return now, nil
+	}
+
+	var next time.Time
+	if p.MinTime > 0 {
+		next = p.LastChanged.Add(pm.effectiveMinTime(p))
+		// IP sắp hết hạn: được đổi không cần đợi min_time
+		if !p.IPExpiresAt.IsZero() {
+			if expiring := p.IPExpiresAt.Add(-ipExpiryMargin); expiring.Before(next) {
+				next = expiring
+			}
+		}
+	}
+	if p.NextChangeAt.After(next) {
+		next = p.NextChangeAt
+	}
+	if limitedUntil := pm.rotationLimitedUntil(p, now); limitedUntil.After(next) {
+		next = limitedUntil
+	}
+	return next, nil
+}
+
+// rotationLimitedUntil thời điểm api key của proxy hết bị MaxRotationsPerHour chặn (zero nếu không bị chặn)
+func (pm *ProxyManager) rotationLimitedUntil(p *Proxy, now time.Time) time.Time {
+	if pm.maxRotationsPerHour <= 0 || !isProviderType(p.Type) {
+		return time.Time{}
+	}
+	count := pm.rotationCount(p, now)
+	if count < pm.maxRotationsPerHour {
+		return time.Time{}
+	}
+	// Cần thêm 1 lượt: lần đổi IP thứ (count - max + 1) cũ nhất trong cửa sổ ra khỏi cửa sổ
+	var rotatedAt int64
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	err := pm.db.QueryRow(`SELECT rotated_at FROM proxy_rotations WHERE unique_key=? AND rotated_at>? ORDER BY rotated_at ASC LIMIT 1 OFFSET ?`,
+		proxyUniqueKey(p.Type, p.ApiKey), now.Add(-rotationWindow).Unix(), count-pm.maxRotationsPerHour).Scan(&rotatedAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(rotatedAt, 0).Add(rotationWindow)
+}
@@ -0,0 +1,187 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule lịch chạy dạng cron 5 trường: phút giờ ngày tháng thứ
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// every > 0: lịch dạng "@every <duration>"
+	every time.Duration
+}
+
+// parseCronSpec parse cron spec
+// Hỗ trợ:
+// - 5 trường chuẩn: "phút giờ ngày tháng thứ" với *, */n, a-b, a-b/n, a,b
+// - Các alias: @hourly, @daily (@midnight), @weekly, @monthly, @yearly (@annually)
+// - "@every <duration>" (ví dụ: @every 30m)
+func parseCronSpec(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid @every duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid @every duration: %s", d)
+		}
+		return &cronSchedule{every: d}, nil
+	}
+
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	case "@yearly", "@annually":
+		spec = "0 0 1 1 *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron spec %q: expected 5 fields", spec)
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [5]map[int]bool
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron spec %q: %w", spec, err)
+		}
+		sets[i] = set
+	}
+
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+	}, nil
+}
+
+// parseCronField parse 1 trường cron thành tập các giá trị hợp lệ trong [min, max]
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			val, err := strconv.Atoi(part[idx+1:])
+			if err != nil || val <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = val
+			part = part[:idx]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			a, err1 := strconv.Atoi(bounds[0])
+			b, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			lo, hi = a, b
+		default:
+			val, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = val, val
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range [%d-%d] in %q", min, max, part)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// next trả về thời điểm chạy tiếp theo sau t
+func (c *cronSchedule) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+
+	// Duyệt từng phút, tối đa 5 năm (đủ cho mọi spec hợp lệ, ví dụ 29/2)
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		if c.month[int(next.Month())] && c.dom[next.Day()] && c.dow[int(next.Weekday())] &&
+			c.hour[next.Hour()] && c.minute[next.Minute()] {
+			return next
+		}
+		next = next.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// ScheduleRotation đặt lịch gọi RotateAllEligible theo cron spec
+// Ví dụ: "0 * * * *" (đầu mỗi giờ), "*/15 * * * *", "@hourly", "@every 30m"
+// Gọi lại ScheduleRotation sẽ thay thế lịch cũ, dùng StopSchedule để huỷ (Close cũng huỷ lịch)
+func (pm *ProxyManager) ScheduleRotation(spec string) error {
+	schedule, err := parseCronSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(pm.baseContext())
+
+	pm.mu.Lock()
+	if pm.scheduleCancel != nil {
+		pm.scheduleCancel()
+	}
+	pm.scheduleCancel = cancel
+	pm.mu.Unlock()
+
+	go func() {
+		for {
+			now := time.Now()
+			next := schedule.next(now)
+			if next.IsZero() {
+				return
+			}
+
+			timer := time.NewTimer(next.Sub(now))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			rotated, err := pm.RotateAllEligible()
+			if err != nil {
+				pm.logf("[ProxyManager] Scheduled rotation: rotated %d proxies, errors: %v\n", rotated, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopSchedule huỷ lịch rotation đang chạy (nếu có)
+func (pm *ProxyManager) StopSchedule() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.scheduleCancel != nil {
+		pm.scheduleCancel()
+		pm.scheduleCancel = nil
+	}
+}
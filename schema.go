@@ -0,0 +1,201 @@
+package goproxy
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// schemaMigration một bước nâng cấp schema, version = vị trí trong schemaMigrations + 1
+type schemaMigration struct {
+	name  string
+	apply func(tx *sql.Tx) error
+}
+
+// schemaMigrations danh sách migration theo thứ tự, chỉ được thêm vào cuối (không sửa/xoá/đổi thứ tự bước cũ)
+var schemaMigrations = []schemaMigration{
+	{"add is_unique", addColumn("proxies", "is_unique", "INTEGER DEFAULT 0")},
+	// Cập nhật is_unique=1 cho các proxy type cũ
+	{"backfill is_unique", execMigration(`UPDATE proxies SET is_unique=1 WHERE type IN ('tmproxy', 'mobilehop', 'static', 'kiotproxy', 'auto', 'ipv4xoay')`)},
+	{"add thread_id", addColumn("proxies", "thread_id", "INTEGER")},
+	{"add latency_ms", addColumn("proxies", "latency_ms", "INTEGER DEFAULT 0")},
+	// Thông tin từ provider
+	{"add location", addColumn("proxies", "location", "TEXT")},
+	{"add isp", addColumn("proxies", "isp", "TEXT")},
+	{"add expires_at", addColumn("proxies", "expires_at", "INTEGER")},
+	// Cooldown đổi IP do provider trả về
+	{"add next_change_at", addColumn("proxies", "next_change_at", "INTEGER")},
+	// Sticky unique tạo session mới mỗi lần lấy
+	{"add fresh_session", addColumn("proxies", "fresh_session", "INTEGER DEFAULT 0")},
+	// Api key cho phép nhiều session song song
+	{"add parallel_sessions", addColumn("proxies", "parallel_sessions", "INTEGER DEFAULT 0")},
+	// tmproxy chọn tỉnh/nhà mạng khi GetNewProxy
+	{"add id_location", addColumn("proxies", "id_location", "INTEGER DEFAULT 0")},
+	{"add id_isp", addColumn("proxies", "id_isp", "INTEGER DEFAULT 0")},
+	// ipv4xoay chọn nhà mạng/tỉnh thành khi lấy proxy
+	{"add nhamang", addColumn("proxies", "nhamang", "TEXT")},
+	{"add tinhthanh", addColumn("proxies", "tinhthanh", "TEXT")},
+	// Nhóm proxy, dạng ",us,mobile,"
+	{"add tags", addColumn("proxies", "tags", "TEXT")},
+	// mobilehop: method/header/body khi gọi change_url, dạng JSON
+	{"add change_request", addColumn("proxies", "change_request", "TEXT")},
+	// NonBlockingChangeWait: thời điểm proxy vừa đổi IP được cấp phát lại
+	{"add ready_at", addColumn("proxies", "ready_at", "INTEGER")},
+	// DrainProxy: ngừng cấp phát nhưng giữ lại proxy
+	{"add draining", addColumn("proxies", "draining", "INTEGER DEFAULT 0")},
+	// Trọng số cho StrategyWeightedRandom
+	{"add weight", addColumn("proxies", "weight", "REAL DEFAULT 1")},
+	// Thời điểm set error, dùng cho ErrorCooldown
+	{"add error_at", addColumn("proxies", "error_at", "INTEGER")},
+	// Thời điểm IP hiện tại hết hạn (kiotproxy: ttl)
+	{"add ip_expires_at", addColumn("proxies", "ip_expires_at", "INTEGER")},
+	// Proxy bị hạ cấp do health score thấp
+	{"add demoted_until", addColumn("proxies", "demoted_until", "INTEGER")},
+	// Thời điểm proxy được cấp phát, dùng cho LeaseTTL
+	{"add running_since", addColumn("proxies", "running_since", "INTEGER")},
+	// Provider: dùng proxy SOCKS5 thay cho HTTP, cờ "socks5"
+	{"add socks5", addColumn("proxies", "socks5", "INTEGER DEFAULT 0")},
+	// Provider: proxy HTTP/SOCKS5 của cùng IP, xem GetAvailableProxySOCKS5
+	{"add http_str", addColumn("proxies", "http_str", "TEXT")},
+	{"add socks5_str", addColumn("proxies", "socks5_str", "TEXT")},
+	// Nhóm lỗi của error, xem ErrorCategory
+	{"add error_category", addColumn("proxies", "error_category", "TEXT")},
+}
+
+// addColumn thêm cột nếu bảng chưa có, database tạo trước khi có schema_version có thể đã có sẵn cột
+func addColumn(table, column, def string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+		_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, def))
+		return err
+	}
+}
+
+// execMigration migration chỉ gồm 1 câu lệnh SQL
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+func (pm *ProxyManager) initSchema() error {
+	return migrateSchema(pm.db)
+}
+
+// migrateSchema tạo các bảng nếu chưa có rồi chạy các migration chưa được áp dụng (theo schema_version).
+// Mỗi migration chạy trong 1 transaction cùng với việc ghi version, lỗi được trả về thay vì bỏ qua
+func migrateSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS proxies (
+		id INTEGER PRIMARY KEY,
+		type TEXT NOT NULL,
+		proxy_str TEXT,
+		api_key TEXT,
+		unique_key TEXT UNIQUE,
+		min_time INTEGER,
+		change_url TEXT,
+		running INTEGER DEFAULT 0,
+		used INTEGER DEFAULT 0,
+		last_changed INTEGER,
+		last_ip TEXT,
+		error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_type ON proxies(type);
+	CREATE INDEX IF NOT EXISTS idx_unique_key ON proxies(unique_key);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Bảng lịch sử sử dụng proxy (chỉ ghi khi Config.TrackUsage = true)
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS proxy_usage (
+		id INTEGER PRIMARY KEY,
+		proxy_id INTEGER NOT NULL,
+		thread_id INTEGER,
+		acquired_at INTEGER NOT NULL,
+		released_at INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS idx_usage_proxy_acquired ON proxy_usage(proxy_id, acquired_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Bảng các lần đổi IP qua provider theo unique_key (Config.MaxRotationsPerHour), không bị xoá khi ClearAllProxy
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS proxy_rotations (
+		id INTEGER PRIMARY KEY,
+		unique_key TEXT NOT NULL,
+		rotated_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_rotations_key_rotated ON proxy_rotations(unique_key, rotated_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Mỗi migration đã áp dụng là 1 dòng, version hiện tại = MAX(version)
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT,
+		applied_at INTEGER NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for i := current; i < len(schemaMigrations); i++ {
+		if err := applyMigration(db, i+1, schemaMigrations[i]); err != nil {
+			return fmt.Errorf("schema migration %d (%s): %w", i+1, schemaMigrations[i].name, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion version schema hiện tại của database (0 = chưa chạy migration nào)
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+func applyMigration(db *sql.DB, version int, m schemaMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Process khác dùng chung file database có thể đã áp dụng migration này
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_version WHERE version = ?`, version).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`, version, m.name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
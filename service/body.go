@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// DefaultMaxResponseBytes giới hạn mặc định kích thước response body (4MB)
+const DefaultMaxResponseBytes int64 = 4 << 20
+
+// ErrResponseTooLarge trả về khi response body vượt quá giới hạn MaxResponseBytes
+var ErrResponseTooLarge = errors.New("response body too large")
+
+var maxResponseBytes atomic.Int64
+
+func init() {
+	maxResponseBytes.Store(DefaultMaxResponseBytes)
+}
+
+// SetMaxResponseBytes thay đổi giới hạn kích thước response body (<= 0: dùng DefaultMaxResponseBytes)
+func SetMaxResponseBytes(n int64) {
+	if n <= 0 {
+		n = DefaultMaxResponseBytes
+	}
+	maxResponseBytes.Store(n)
+}
+
+// MaxResponseBytes trả về giới hạn kích thước response body hiện tại
+func MaxResponseBytes() int64 {
+	return maxResponseBytes.Load()
+}
+
+// ReadBody đọc toàn bộ body nhưng không quá MaxResponseBytes, vượt quá trả về ErrResponseTooLarge
+func ReadBody(r io.Reader) ([]byte, error) {
+	limit := MaxResponseBytes()
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w (limit %d bytes)", ErrResponseTooLarge, limit)
+	}
+	return body, nil
+}
@@ -1,9 +1,9 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"sync"
 )
@@ -26,7 +26,8 @@ type IPv4XoayResponse struct {
 
 // IPv4Xoay service để interact với IPv4Xoay API (Singleton)
 type IPv4Xoay struct {
-	client *http.Client
+	client  *http.Client
+	baseURL string
 }
 
 var (
@@ -38,24 +39,42 @@ var (
 func GetIPv4Xoay() *IPv4Xoay {
 	ipv4xoayOnce.Do(func() {
 		ipv4xoayInstance = &IPv4Xoay{
-			client: &http.Client{},
+			client:  newHTTPClient(),
+			baseURL: ipv4xoayBaseURL,
 		}
 	})
 	return ipv4xoayInstance
 }
 
+// SetBaseURL thay đổi base URL của API (dùng cho mirror hoặc mock server khi test)
+func (i *IPv4Xoay) SetBaseURL(baseURL string) {
+	i.baseURL = baseURL
+}
+
 // GetProxy lấy proxy từ IPv4Xoay (xài chung API cho cả GetNew và GetCurrent)
+// nhamang: nhà mạng (mặc định "random"), tinhthanh: tỉnh thành (mặc định "0" = ngẫu nhiên)
 // Phương án 3: Nếu bị block (status 101), return (nil, nil) để thử lại sau
-func (i *IPv4Xoay) GetProxy(apiKey string) (*IPv4XoayResponse, error) {
-	url := fmt.Sprintf("%s?key=%s&nhamang=random&tinhthanh=0", ipv4xoayBaseURL, apiKey)
+func (i *IPv4Xoay) GetProxy(apiKey, nhamang, tinhthanh string) (*IPv4XoayResponse, error) {
+	return i.GetProxyContext(context.Background(), apiKey, nhamang, tinhthanh)
+}
+
+// GetProxyContext giống GetProxy, request bị huỷ khi ctx bị huỷ
+func (i *IPv4Xoay) GetProxyContext(ctx context.Context, apiKey, nhamang, tinhthanh string) (*IPv4XoayResponse, error) {
+	if nhamang == "" {
+		nhamang = "random"
+	}
+	if tinhthanh == "" {
+		tinhthanh = "0"
+	}
+	url := fmt.Sprintf("%s?key=%s&nhamang=%s&tinhthanh=%s", i.baseURL, apiKey, nhamang, tinhthanh)
 
-	resp, err := i.client.Get(url)
+	resp, err := getContext(ctx, i.client, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := ReadBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -80,11 +99,35 @@ func (i *IPv4Xoay) GetProxy(apiKey string) (*IPv4XoayResponse, error) {
 }
 
 // GetNewProxy wrapper để compatible với logic LoadProxiesFromList
-func (i *IPv4Xoay) GetNewProxy(apiKey string) (*IPv4XoayResponse, error) {
-	return i.GetProxy(apiKey)
+func (i *IPv4Xoay) GetNewProxy(apiKey, nhamang, tinhthanh string) (*IPv4XoayResponse, error) {
+	return i.GetProxy(apiKey, nhamang, tinhthanh)
 }
 
 // GetCurrentProxy wrapper để compatible với logic LoadProxiesFromList
-func (i *IPv4Xoay) GetCurrentProxy(apiKey string) (*IPv4XoayResponse, error) {
-	return i.GetProxy(apiKey)
+func (i *IPv4Xoay) GetCurrentProxy(apiKey, nhamang, tinhthanh string) (*IPv4XoayResponse, error) {
+	return i.GetProxy(apiKey, nhamang, tinhthanh)
+}
+
+// GetNewProxyContext giống GetNewProxy, request bị huỷ khi ctx bị huỷ
+func (i *IPv4Xoay) GetNewProxyContext(ctx context.Context, apiKey, nhamang, tinhthanh string) (*IPv4XoayResponse, error) {
+	return i.GetProxyContext(ctx, apiKey, nhamang, tinhthanh)
+}
+
+// GetCurrentProxyContext giống GetCurrentProxy, request bị huỷ khi ctx bị huỷ
+func (i *IPv4Xoay) GetCurrentProxyContext(ctx context.Context, apiKey, nhamang, tinhthanh string) (*IPv4XoayResponse, error) {
+	return i.GetProxyContext(ctx, apiKey, nhamang, tinhthanh)
+}
+
+// Ping kiểm tra api key. IPv4Xoay chỉ có 1 API (GetProxy) nên Ping cũng là 1 lần lấy proxy
+// Status 101 (bị block tạm thời) được coi là key hợp lệ
+// Trả về nil nếu key hợp lệ, lỗi bọc ErrProviderUnreachable hoặc ErrInvalidKey nếu không
+func (i *IPv4Xoay) Ping(apiKey string) error {
+	resp, err := i.GetProxy(apiKey, "", "")
+	if err != nil && resp == nil {
+		return unreachable("ipv4xoay", err)
+	}
+	if err != nil {
+		return invalidKey("ipv4xoay", "status: %d, message: %s", resp.Status, resp.Message)
+	}
+	return nil
 }
@@ -1,9 +1,9 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"sync"
 )
@@ -40,7 +40,8 @@ type KiotProxyData struct {
 
 // KiotProxy service để interact với KiotProxy API (Singleton)
 type KiotProxy struct {
-	client *http.Client
+	client  *http.Client
+	baseURL string
 }
 
 var (
@@ -52,26 +53,37 @@ var (
 func GetKiotProxy() *KiotProxy {
 	kiotproxyOnce.Do(func() {
 		kiotproxyInstance = &KiotProxy{
-			client: &http.Client{},
+			client:  newHTTPClient(),
+			baseURL: kiotproxyBaseURL,
 		}
 	})
 	return kiotproxyInstance
 }
 
+// SetBaseURL thay đổi base URL của API (dùng cho mirror hoặc mock server khi test)
+func (k *KiotProxy) SetBaseURL(baseURL string) {
+	k.baseURL = baseURL
+}
+
 // GetNewProxy lấy proxy mới từ KiotProxy
 func (k *KiotProxy) GetNewProxy(apiKey, region string) (*KiotProxyResponse, error) {
-	url := fmt.Sprintf("%s/new?key=%s", kiotproxyBaseURL, apiKey)
+	return k.GetNewProxyContext(context.Background(), apiKey, region)
+}
+
+// GetNewProxyContext giống GetNewProxy, request bị huỷ khi ctx bị huỷ
+func (k *KiotProxy) GetNewProxyContext(ctx context.Context, apiKey, region string) (*KiotProxyResponse, error) {
+	url := fmt.Sprintf("%s/new?key=%s", k.baseURL, apiKey)
 	if region != "" {
 		url += fmt.Sprintf("&region=%s", region)
 	}
 
-	resp, err := k.client.Get(url)
+	resp, err := getContext(ctx, k.client, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := ReadBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -90,15 +102,20 @@ func (k *KiotProxy) GetNewProxy(apiKey, region string) (*KiotProxyResponse, erro
 
 // GetCurrentProxy lấy proxy hiện tại từ KiotProxy
 func (k *KiotProxy) GetCurrentProxy(apiKey string) (*KiotProxyResponse, error) {
-	url := fmt.Sprintf("%s/current?key=%s", kiotproxyBaseURL, apiKey)
+	return k.GetCurrentProxyContext(context.Background(), apiKey)
+}
 
-	resp, err := k.client.Get(url)
+// GetCurrentProxyContext giống GetCurrentProxy, request bị huỷ khi ctx bị huỷ
+func (k *KiotProxy) GetCurrentProxyContext(ctx context.Context, apiKey string) (*KiotProxyResponse, error) {
+	url := fmt.Sprintf("%s/current?key=%s", k.baseURL, apiKey)
+
+	resp, err := getContext(ctx, k.client, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := ReadBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -115,3 +132,16 @@ func (k *KiotProxy) GetCurrentProxy(apiKey string) (*KiotProxyResponse, error) {
 	return &result, nil
 }
 
+
+// Ping kiểm tra api key bằng current (không đổi IP)
+// Trả về nil nếu key hợp lệ, lỗi bọc ErrProviderUnreachable hoặc ErrInvalidKey nếu không
+func (k *KiotProxy) Ping(apiKey string) error {
+	resp, err := k.GetCurrentProxy(apiKey)
+	if err != nil && resp == nil {
+		return unreachable("kiotproxy", err)
+	}
+	if !resp.Success {
+		return invalidKey("kiotproxy", "code: %d, message: %s, error: %s", resp.Code, resp.Message, resp.Error)
+	}
+	return nil
+}
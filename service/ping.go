@@ -0,0 +1,22 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Lỗi trả về từ Ping của các service, kiểm tra bằng errors.Is
+var (
+	// ErrProviderUnreachable không gọi được API provider (mất mạng, DNS, timeout, status HTTP lỗi, response không hợp lệ)
+	ErrProviderUnreachable = errors.New("provider unreachable")
+	// ErrInvalidKey API provider trả lời nhưng từ chối api key (sai key, hết hạn, bị khoá)
+	ErrInvalidKey = errors.New("invalid api key")
+)
+
+func unreachable(provider string, err error) error {
+	return fmt.Errorf("%s: %w: %v", provider, ErrProviderUnreachable, err)
+}
+
+func invalidKey(provider string, format string, args ...any) error {
+	return fmt.Errorf("%s: %w: %s", provider, ErrInvalidKey, fmt.Sprintf(format, args...))
+}
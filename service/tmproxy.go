@@ -2,11 +2,13 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -18,6 +20,10 @@ type TMProxyResponse struct {
 	Code    int         `json:"code"`
 	Message string      `json:"message"`
 	Data    TMProxyData `json:"data"`
+
+	// ServerTime thời điểm theo đồng hồ TMProxy (header Date của response), zero nếu không có.
+	// Dùng để quy đổi ExpiredAt sang đồng hồ local khi hai bên lệch giờ
+	ServerTime time.Time `json:"-"`
 }
 
 // TMProxyData chứa thông tin proxy từ TMProxy
@@ -37,7 +43,8 @@ type TMProxyData struct {
 
 // TMProxy service để interact với TMProxy API (Singleton)
 type TMProxy struct {
-	client *http.Client
+	client  *http.Client
+	baseURL string
 }
 
 var (
@@ -49,12 +56,18 @@ var (
 func GetTMProxy() *TMProxy {
 	tmproxyOnce.Do(func() {
 		tmproxyInstance = &TMProxy{
-			client: &http.Client{},
+			client:  newHTTPClient(),
+			baseURL: tmproxyBaseURL,
 		}
 	})
 	return tmproxyInstance
 }
 
+// SetBaseURL thay đổi base URL của API (dùng cho mirror hoặc mock server khi test)
+func (t *TMProxy) SetBaseURL(baseURL string) {
+	t.baseURL = baseURL
+}
+
 // GetNewProxyRequest payload cho get-new-proxy
 type GetNewProxyRequest struct {
 	APIKey     string `json:"api_key"`
@@ -64,6 +77,11 @@ type GetNewProxyRequest struct {
 
 // GetNewProxy lấy proxy mới từ TMProxy
 func (t *TMProxy) GetNewProxy(apiKey string, idLocation, idISP int) (*TMProxyResponse, error) {
+	return t.GetNewProxyContext(context.Background(), apiKey, idLocation, idISP)
+}
+
+// GetNewProxyContext giống GetNewProxy, request bị huỷ khi ctx bị huỷ
+func (t *TMProxy) GetNewProxyContext(ctx context.Context, apiKey string, idLocation, idISP int) (*TMProxyResponse, error) {
 	payload := GetNewProxyRequest{
 		APIKey:     apiKey,
 		IDLocation: idLocation,
@@ -75,17 +93,13 @@ func (t *TMProxy) GetNewProxy(apiKey string, idLocation, idISP int) (*TMProxyRes
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	resp, err := t.client.Post(
-		fmt.Sprintf("%s/get-new-proxy", tmproxyBaseURL),
-		"application/json",
-		bytes.NewBuffer(data),
-	)
+	resp, err := t.post(ctx, "get-new-proxy", data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := ReadBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -98,10 +112,30 @@ func (t *TMProxy) GetNewProxy(apiKey string, idLocation, idISP int) (*TMProxyRes
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
+	result.ServerTime = responseTime(resp)
 
 	return &result, nil
 }
 
+// post gửi payload JSON tới endpoint path của TMProxy API, request bị huỷ khi ctx bị huỷ
+func (t *TMProxy) post(ctx context.Context, path string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", t.baseURL, path), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return t.client.Do(req)
+}
+
+// responseTime thời điểm server trả response (header Date), zero nếu không có hoặc không parse được
+func responseTime(resp *http.Response) time.Time {
+	t, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
 // GetCurrentProxyRequest payload cho get-current-proxy
 type GetCurrentProxyRequest struct {
 	APIKey string `json:"api_key"`
@@ -109,6 +143,11 @@ type GetCurrentProxyRequest struct {
 
 // GetCurrentProxy lấy proxy hiện tại từ TMProxy
 func (t *TMProxy) GetCurrentProxy(apiKey string) (*TMProxyResponse, error) {
+	return t.GetCurrentProxyContext(context.Background(), apiKey)
+}
+
+// GetCurrentProxyContext giống GetCurrentProxy, request bị huỷ khi ctx bị huỷ
+func (t *TMProxy) GetCurrentProxyContext(ctx context.Context, apiKey string) (*TMProxyResponse, error) {
 	payload := GetCurrentProxyRequest{
 		APIKey: apiKey,
 	}
@@ -118,17 +157,64 @@ func (t *TMProxy) GetCurrentProxy(apiKey string) (*TMProxyResponse, error) {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	resp, err := t.client.Post(
-		fmt.Sprintf("%s/get-current-proxy", tmproxyBaseURL),
-		"application/json",
-		bytes.NewBuffer(data),
-	)
+	resp, err := t.post(ctx, "get-current-proxy", data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ReadBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tmproxy api returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result TMProxyResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	result.ServerTime = responseTime(resp)
+
+	return &result, nil
+}
+
+// AuthorizeIPRequest payload cho update-ip-allow
+type AuthorizeIPRequest struct {
+	APIKey  string `json:"api_key"`
+	IPAllow string `json:"ip_allow"`
+}
+
+// AuthorizeIP thêm ip vào danh sách ip_allow (whitelist) của api key
+// update-ip-allow ghi đè cả danh sách nên ip_allow hiện tại (get-current-proxy) được giữ lại, ip chỉ được thêm nếu chưa có
+func (t *TMProxy) AuthorizeIP(apiKey, ip string) (*TMProxyResponse, error) {
+	current, err := t.GetCurrentProxy(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current ip_allow: %w", err)
+	}
+	if current.Code != 0 {
+		return current, fmt.Errorf("failed to get current ip_allow: code: %d, message: %s", current.Code, current.Message)
+	}
+
+	payload := AuthorizeIPRequest{
+		APIKey:  apiKey,
+		IPAllow: mergeIPAllow(current.Data.IPAllow, ip),
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := t.post(context.Background(), "update-ip-allow", data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := ReadBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -142,5 +228,36 @@ func (t *TMProxy) GetCurrentProxy(apiKey string) (*TMProxyResponse, error) {
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
+	if result.Code != 0 {
+		return &result, fmt.Errorf("tmproxy api returned code: %d, message: %s", result.Code, result.Message)
+	}
+
 	return &result, nil
 }
+
+// mergeIPAllow thêm ip vào danh sách ip_allow (phân cách bởi dấu phẩy, chấm phẩy hoặc khoảng trắng),
+// bỏ các ip trùng, trả về danh sách phân cách bởi dấu phẩy
+func mergeIPAllow(ipAllow, ip string) string {
+	var ips []string
+	seen := make(map[string]bool)
+	for _, allowed := range append(strings.FieldsFunc(ipAllow, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }), ip) {
+		if !seen[allowed] {
+			seen[allowed] = true
+			ips = append(ips, allowed)
+		}
+	}
+	return strings.Join(ips, ",")
+}
+
+// Ping kiểm tra api key bằng get-current-proxy (không đổi IP)
+// Trả về nil nếu key hợp lệ, lỗi bọc ErrProviderUnreachable hoặc ErrInvalidKey nếu không
+func (t *TMProxy) Ping(apiKey string) error {
+	resp, err := t.GetCurrentProxy(apiKey)
+	if err != nil {
+		return unreachable("tmproxy", err)
+	}
+	if resp.Code != 0 {
+		return invalidKey("tmproxy", "code: %d, message: %s", resp.Code, resp.Message)
+	}
+	return nil
+}
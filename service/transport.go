@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// requestTimeout thời gian tối đa của 1 lần gọi API provider, tránh API treo làm LoadProxiesFromList/GetAvailableProxy
+// bị block mãi (ctx của caller vẫn có thể huỷ sớm hơn)
+const requestTimeout = 30 * time.Second
+
+// sharedTransport transport dùng chung cho client của các provider, giữ kết nối (TLS) tới API để dùng lại
+// giữa các lần gọi thay vì mở kết nối mới mỗi lần đổi IP
+var sharedTransport = newTransport()
+
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 100
+	// Mặc định chỉ giữ 2 kết nối rảnh cho mỗi host, không đủ khi nhiều proxy đổi IP cùng lúc
+	t.MaxIdleConnsPerHost = 32
+	t.IdleConnTimeout = 90 * time.Second
+	t.ForceAttemptHTTP2 = true
+	return t
+}
+
+// newHTTPClient tạo http.Client dùng sharedTransport
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: sharedTransport, Timeout: requestTimeout}
+}
+
+// getContext gửi GET request tới url, request bị huỷ khi ctx bị huỷ
+func getContext(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,101 @@
+package goproxy
+
+// standbyProxy proxy được lấy sẵn cho 1 thread (PrefetchPerThread)
+type standbyProxy struct {
+	done     chan struct{} // đóng khi đã lấy xong
+	id       int64
+	proxyStr string
+	err      error
+}
+
+// prefetchStandby lấy sẵn proxy tiếp theo cho thread (chạy nền)
+// Mỗi thread chỉ giữ tối đa 1 proxy standby
+func (pm *ProxyManager) prefetchStandby(threadId int) {
+	pm.standbyMu.Lock()
+	if _, ok := pm.standby[threadId]; ok {
+		pm.standbyMu.Unlock()
+		return
+	}
+	sp := &standbyProxy{done: make(chan struct{})}
+	pm.standby[threadId] = sp
+	pm.standbyMu.Unlock()
+
+	go func() {
+		sp.id, sp.proxyStr, sp.err = pm.acquireProxy(threadId, "", 0)
+		close(sp.done)
+	}()
+}
+
+// takeStandby lấy proxy standby của thread (nếu có)
+// Nếu standby đang được lấy thì đợi lấy xong, nếu lấy thất bại trả về ok=false để lấy proxy bình thường
+func (pm *ProxyManager) takeStandby(threadId int) (id int64, proxyStr string, ok bool) {
+	pm.standbyMu.Lock()
+	sp, exists := pm.standby[threadId]
+	if exists {
+		delete(pm.standby, threadId)
+	}
+	pm.standbyMu.Unlock()
+
+	if !exists {
+		return 0, "", false
+	}
+	<-sp.done
+	if sp.err != nil {
+		return 0, "", false
+	}
+
+	// Proxy bị DrainProxy trong lúc làm standby: trả lại, lấy proxy khác
+	pm.mu.RLock()
+	draining := pm.proxyCache[sp.id] != nil && pm.proxyCache[sp.id].Draining
+	pm.mu.RUnlock()
+	if draining {
+		pm.releaseProxy(sp.id)
+		return 0, "", false
+	}
+	return sp.id, sp.proxyStr, true
+}
+
+// ReleaseStandby trả lại proxy standby đang giữ cho thread (khi thread dừng hẳn)
+func (pm *ProxyManager) ReleaseStandby(threadId int) {
+	pm.standbyMu.Lock()
+	sp, exists := pm.standby[threadId]
+	if exists {
+		delete(pm.standby, threadId)
+	}
+	pm.standbyMu.Unlock()
+
+	if !exists {
+		return
+	}
+	<-sp.done
+	if sp.err == nil {
+		// Release trực tiếp, không prefetch lại cho thread
+		pm.releaseProxy(sp.id)
+	}
+}
+
+// lockWithoutPendingStandby giữ pm.mu và pm.standbyMu khi không còn proxy standby nào đang được lấy,
+// để proxy standby lấy xong sau đó không bị giữ mà không thread nào nhận (caller phải unlock cả 2)
+func (pm *ProxyManager) lockWithoutPendingStandby() {
+	for {
+		pm.mu.Lock()
+		pm.standbyMu.Lock()
+		var pending *standbyProxy
+		for _, sp := range pm.standby {
+			select {
+			case <-sp.done:
+			default:
+				pending = sp
+			}
+			if pending != nil {
+				break
+			}
+		}
+		if pending == nil {
+			return
+		}
+		pm.standbyMu.Unlock()
+		pm.mu.Unlock()
+		<-pending.done
+	}
+}
@@ -0,0 +1,157 @@
+package goproxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PoolState snapshot của bảng proxies, dùng cho ExportState/ImportState
+type PoolState struct {
+	ExportedAt time.Time    `json:"exported_at"`
+	Proxies    []ProxyState `json:"proxies"`
+}
+
+// ProxyState trạng thái một proxy trong snapshot
+// Không lưu running/thread_id: proxy import vào luôn ở trạng thái rảnh
+type ProxyState struct {
+	ID               int64         `json:"id"` // chỉ để tham khảo, ImportState upsert theo unique_key
+	Type             ProxyType     `json:"type"`
+	ProxyStr         string        `json:"proxy_str"`
+	ApiKey           string        `json:"api_key,omitempty"`
+	UniqueKey        string        `json:"unique_key"`
+	MinTime          int           `json:"min_time"`
+	ChangeUrl        string        `json:"change_url,omitempty"`
+	Used             int           `json:"used"`
+	Unique           bool          `json:"is_unique"`
+	LastChanged      time.Time     `json:"last_changed"`
+	LastIP           string        `json:"last_ip,omitempty"`
+	Error            string        `json:"error,omitempty"`
+	LatencyMs        int64         `json:"latency_ms,omitempty"`
+	Location         string        `json:"location,omitempty"`
+	ISP              string        `json:"isp,omitempty"`
+	ExpiresAt        time.Time     `json:"expires_at,omitzero"`
+	NextChangeAt     time.Time     `json:"next_change_at,omitzero"`
+	FreshSession     bool          `json:"fresh_session,omitempty"`
+	ParallelSessions bool          `json:"parallel_sessions,omitempty"`
+	IDLocation       int           `json:"id_location,omitempty"`
+	IDISP            int           `json:"id_isp,omitempty"`
+	NhaMang          string        `json:"nhamang,omitempty"`
+	TinhThanh        string        `json:"tinhthanh,omitempty"`
+	Draining         bool          `json:"draining,omitempty"`
+	ChangeRequest    ChangeRequest `json:"change_request,omitzero"`
+	Tags             []string      `json:"tags,omitempty"`
+	Weight           float64       `json:"weight,omitempty"`
+	SOCKS5           bool          `json:"socks5,omitempty"`
+	HTTPStr          string        `json:"http_str,omitempty"`
+	SOCKS5Str        string        `json:"socks5_str,omitempty"`
+}
+
+// ExportState xuất toàn bộ bảng proxies (kể cả proxy lỗi) ra JSON
+func (pm *ProxyManager) ExportState() ([]byte, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	rows, err := pm.db.Query(`
+		SELECT id, type, proxy_str, api_key, unique_key, min_time, change_url, used, is_unique, last_changed, last_ip, error, latency_ms, location, isp, expires_at, next_change_at, fresh_session, parallel_sessions, id_location, id_isp, nhamang, tinhthanh, draining, change_request, tags, COALESCE(weight, 1), socks5, http_str, socks5_str
+		FROM proxies
+		ORDER BY id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	state := PoolState{ExportedAt: time.Now(), Proxies: []ProxyState{}}
+	for rows.Next() {
+		var s ProxyState
+		var proxyStr, apiKey, uniqueKey, changeUrl, lastIP, errStr, location, isp, nhamang, tinhthanh, changeRequest, tags, httpStr, socks5Str sql.NullString
+		var minTime, lastChanged, latencyMs, expiresAt, nextChangeAt sql.NullInt64
+		err := rows.Scan(&s.ID, &s.Type, &proxyStr, &apiKey, &uniqueKey, &minTime, &changeUrl, &s.Used, &s.Unique, &lastChanged, &lastIP, &errStr, &latencyMs, &location, &isp, &expiresAt, &nextChangeAt, &s.FreshSession, &s.ParallelSessions, &s.IDLocation, &s.IDISP, &nhamang, &tinhthanh, &s.Draining, &changeRequest, &tags, &s.Weight, &s.SOCKS5, &httpStr, &socks5Str)
+		if err != nil {
+			return nil, err
+		}
+		s.ProxyStr = proxyStr.String
+		s.ApiKey = apiKey.String
+		s.UniqueKey = uniqueKey.String
+		s.MinTime = int(minTime.Int64)
+		s.ChangeUrl = changeUrl.String
+		s.LastIP = lastIP.String
+		s.Error = errStr.String
+		s.LatencyMs = latencyMs.Int64
+		s.Location = location.String
+		s.ISP = isp.String
+		s.ChangeRequest = parseChangeRequest(changeRequest.String)
+		s.Tags = decodeTags(tags.String)
+		s.NhaMang = nhamang.String
+		s.TinhThanh = tinhthanh.String
+		s.HTTPStr = httpStr.String
+		s.SOCKS5Str = socks5Str.String
+		if lastChanged.Valid {
+			s.LastChanged = time.Unix(lastChanged.Int64, 0)
+		}
+		if expiresAt.Valid && expiresAt.Int64 > 0 {
+			s.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+		}
+		if nextChangeAt.Valid && nextChangeAt.Int64 > 0 {
+			s.NextChangeAt = time.Unix(nextChangeAt.Int64, 0)
+		}
+		state.Proxies = append(state.Proxies, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// ImportState nạp lại snapshot từ ExportState, upsert theo unique_key
+// Proxy đã có được cập nhật used/last_changed/error..., proxy chưa có được thêm mới
+// Proxy không có trong snapshot giữ nguyên
+func (pm *ProxyManager) ImportState(data []byte) error {
+	var state PoolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid state: %w", err)
+	}
+	for i, s := range state.Proxies {
+		if s.Type == "" || s.UniqueKey == "" {
+			return fmt.Errorf("invalid state: proxy %d missing type or unique_key", i)
+		}
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, s := range state.Proxies {
+		if s.Weight <= 0 {
+			s.Weight = 1
+		}
+		id, _, err := pm.upsertProxy(s.Type, s.ProxyStr, s.ApiKey, s.ChangeUrl, s.MinTime, s.UniqueKey, s.Unique, s.LastChanged, s.Error)
+		if err != nil {
+			return err
+		}
+
+		var expiresAt, nextChangeAt int64
+		if !s.ExpiresAt.IsZero() {
+			expiresAt = s.ExpiresAt.Unix()
+		}
+		if !s.NextChangeAt.IsZero() {
+			nextChangeAt = s.NextChangeAt.Unix()
+		}
+		_, err = pm.db.Exec(`UPDATE proxies SET used=?, last_ip=?, latency_ms=?, location=?, isp=?, expires_at=?, next_change_at=?, fresh_session=?, parallel_sessions=?, id_location=?, id_isp=?, nhamang=?, tinhthanh=?, draining=?, change_request=?, tags=?, weight=?, socks5=?, http_str=?, socks5_str=? WHERE id=?`,
+			s.Used, s.LastIP, s.LatencyMs, s.Location, s.ISP, expiresAt, nextChangeAt, s.FreshSession, s.ParallelSessions, s.IDLocation, s.IDISP, s.NhaMang, s.TinhThanh, s.Draining, encodeChangeRequest(s.ChangeRequest), encodeTags(s.Tags), s.Weight, s.SOCKS5, s.HTTPStr, s.SOCKS5Str, id)
+		if err != nil {
+			return err
+		}
+
+		// Đồng bộ cache với DB
+		p, err := pm.getProxyByID(id)
+		if err != nil {
+			return err
+		}
+		pm.proxyCache[id] = p
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package goproxy
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+)
+
+// DBOpener mở database SQLite cho ProxyManager (file, bộ nhớ, ...).
+// Đây không phải backend lưu trữ tuỳ ý: ProxyManager vẫn tự chạy câu lệnh SQL dialect SQLite trên *sql.DB trả về,
+// DBOpener chỉ quyết định database được mở ở đâu. Database không tương thích SQLite (Postgres, ...) không được hỗ trợ
+type DBOpener interface {
+	// Open mở kết nối tới database, schema do ProxyManager tự khởi tạo
+	Open() (*sql.DB, error)
+}
+
+// SQLiteOpener mở database là file SQLite (mặc định của GetInstance)
+type SQLiteOpener struct {
+	Path string // đường dẫn file database ("" = proxy.db)
+}
+
+// Open mở file SQLite
+func (s SQLiteOpener) Open() (*sql.DB, error) {
+	path := s.Path
+	if path == "" {
+		path = "proxy.db"
+	}
+	return initDB(path)
+}
+
+// memoryOpenerSeq đánh số database in-memory để mỗi MemoryOpener độc lập nhau
+var memoryOpenerSeq atomic.Int64
+
+// MemoryOpener mở database SQLite in-memory, dữ liệu mất khi Close
+type MemoryOpener struct{}
+
+// Open tạo database SQLite in-memory mới (shared cache để mọi connection trong pool cùng thấy dữ liệu)
+func (MemoryOpener) Open() (*sql.DB, error) {
+	name := fmt.Sprintf("file:goproxy_mem_%d?mode=memory&cache=shared", memoryOpenerSeq.Add(1))
+	db, err := initDB(name)
+	if err != nil {
+		return nil, err
+	}
+	// Giữ ít nhất 1 connection mở, database in-memory bị xoá khi connection cuối cùng đóng
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+	return db, nil
+}
@@ -28,14 +28,18 @@ type CheckProxyV4WorkerResponse struct {
 	} `json:"data"`
 }
 
+// ProxyInfo thông tin proxy đã parse từ proxy string (xem ParseProxyInfo)
 type ProxyInfo struct {
-	Protocol string
-	Address  string
+	Protocol string // http (mặc định), https, socks5, socks5h
+	Address  string // ip:port
 	Username string
 	Password string
 }
 
+// CheckProxyState kết quả kiểm tra 1 proxy của CheckProxy/TestAll
 type CheckProxyState struct {
-	Proxy ProxyInfo
-	Info  CheckProxyResponse
+	ProxyID int64 // chỉ có giá trị với TestAll
+	Proxy   ProxyInfo
+	Info    CheckProxyResponse
+	Err     error // lỗi CheckProxy, nil nếu proxy hoạt động (Info chứa IP đi ra, quốc gia, nhà mạng)
 }
@@ -0,0 +1,94 @@
+package goproxy
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// TagStat thống kê số proxy trong 1 nhóm (tag)
+type TagStat struct {
+	Total   int // tổng số proxy có tag
+	Running int // đang được cấp phát
+	Error   int // đang lỗi
+}
+
+// GetAvailableProxyByTag giống GetAvailableProxy nhưng chỉ lấy proxy có tag (tuỳ chọn "tag=NAME" trong proxy string)
+// Tag không phân biệt hoa thường, tag rỗng tương đương GetAvailableProxy.
+// Không có proxy rảnh trong nhóm thì trả về ErrNoAvailableProxy (hoặc đợi theo AcquireWait)
+func (pm *ProxyManager) GetAvailableProxyByTag(threadId int, tag string) (id int64, proxyStr string, err error) {
+	tag = normalizeTag(tag)
+	if tag == "" {
+		return pm.GetAvailableProxy(threadId)
+	}
+	// Proxy standby (PrefetchPerThread) không lọc theo tag nên không dùng ở đây
+	return pm.acquireWithWait(threadId, tag)
+}
+
+// TagStats thống kê số proxy theo từng tag, proxy không có tag nằm ở key ""
+// Proxy có nhiều tag được tính ở mỗi tag
+func (pm *ProxyManager) TagStats() (map[string]TagStat, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	rows, err := pm.db.Query(`SELECT tags, running, error FROM proxies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[string]TagStat)
+	for rows.Next() {
+		var tags, errStr sql.NullString
+		var running bool
+		if err := rows.Scan(&tags, &running, &errStr); err != nil {
+			return nil, err
+		}
+		names := decodeTags(tags.String)
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, name := range names {
+			stat := stats[name]
+			stat.Total++
+			if running {
+				stat.Running++
+			}
+			if errStr.String != "" {
+				stat.Error++
+			}
+			stats[name] = stat
+		}
+	}
+	return stats, rows.Err()
+}
+
+// normalizeTag chuẩn hoá tag: bỏ khoảng trắng, chữ thường
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// encodeTags lưu danh sách tag dạng ",a,b," (sắp xếp, bỏ trùng) để lọc bằng instr(tags, ",tag,")
+func encodeTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	uniq := sorted[:0]
+	for i, tag := range sorted {
+		if i == 0 || tag != sorted[i-1] {
+			uniq = append(uniq, tag)
+		}
+	}
+	return "," + strings.Join(uniq, ",") + ","
+}
+
+// decodeTags đọc cột tags, trả về nil nếu không có tag
+func decodeTags(s string) []string {
+	s = strings.Trim(s, ",")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,65 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// maxWaitBackoff khoảng đợi tối đa giữa 2 lần thử của GetAvailableProxyWait khi không có proxy nào được trả về
+const maxWaitBackoff = time.Second
+
+// GetAvailableProxyWait giống GetAvailableProxy nhưng khi không có proxy rảnh sẽ đợi tới khi có proxy được
+// trả về pool (ReleaseProxy, LeaseTTL) rồi thử lại, tối đa maxWait (0 = chỉ theo ctx).
+// Proxy rảnh trở lại theo thời gian (min_time, ErrorCooldown, ...) được phát hiện nhờ thử lại với backoff
+// (50ms, gấp đôi tới tối đa 1s). Hết maxWait/deadline của ctx: trả về lỗi cuối cùng (ErrNoAvailableProxy),
+// ctx bị huỷ: trả về ctx.Err()
+func (pm *ProxyManager) GetAvailableProxyWait(ctx context.Context, threadId int, maxWait time.Duration) (id int64, proxyStr string, err error) {
+	if maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
+
+	backoff := acquirePollInterval
+	for {
+		// Lấy signal trước khi thử để không bỏ lỡ proxy được trả về giữa lúc thử và lúc đợi
+		released := pm.releaseSignal()
+		id, proxyStr, err = pm.GetAvailableProxy(threadId)
+		if !errors.Is(err, ErrNoAvailableProxy) {
+			return id, proxyStr, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-released:
+		case <-timer.C:
+			backoff *= 2
+			if backoff > maxWaitBackoff {
+				backoff = maxWaitBackoff
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return 0, "", err
+			}
+			return 0, "", ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// releaseSignal trả về channel được đóng ở lần kế tiếp có proxy trả về pool
+func (pm *ProxyManager) releaseSignal() <-chan struct{} {
+	pm.releaseMu.Lock()
+	defer pm.releaseMu.Unlock()
+	return pm.releaseCh
+}
+
+// notifyRelease đánh thức mọi GetAvailableProxyWait đang đợi
+func (pm *ProxyManager) notifyRelease() {
+	pm.releaseMu.Lock()
+	close(pm.releaseCh)
+	pm.releaseCh = make(chan struct{})
+	pm.releaseMu.Unlock()
+}